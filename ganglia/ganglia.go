@@ -8,39 +8,25 @@ import (
 	"flag"
 	"fmt"
 	"html"
-	"io/ioutil"
+	"io"
 	"log"
 	"net"
 	"os"
-	"regexp"
 	"runtime"
-	"strconv"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/fastly/go-utils/debug"
 	"github.com/fastly/go-utils/stopper"
 	"github.com/fastly/go-utils/vlog"
-	"github.com/jbuchbinder/go-gmetric/gmetric"
-)
-
-const (
-	String = gmetric.VALUE_STRING
-	Ushort = gmetric.VALUE_UNSIGNED_SHORT
-	Short  = gmetric.VALUE_SHORT
-	Uint   = gmetric.VALUE_UNSIGNED_INT
-	Int    = gmetric.VALUE_INT
-	Float  = gmetric.VALUE_FLOAT
-	Double = gmetric.VALUE_DOUBLE
 )
 
 var (
-	GmondConfig string
-	Interval    time.Duration
-
-	gmondChannelRe  = regexp.MustCompile("udp_send_channel\\s*{([^}]+)}")
-	gmondHostPortRe = regexp.MustCompile("(host|port)\\s*=\\s*(\\S+)")
+	GmondConfig    string
+	Interval       time.Duration
+	ReloadInterval time.Duration
 
 	globalReporter struct {
 		sync.Once
@@ -51,20 +37,38 @@ var (
 func init() {
 	flag.StringVar(&GmondConfig, "gmond-config", "/etc/ganglia/gmond.conf", "location of gmond.conf")
 	flag.DurationVar(&Interval, "ganglia-interval", 9*time.Second, "time between gmetric updates")
+	flag.DurationVar(&ReloadInterval, "ganglia-reload-interval", 5*time.Minute, "time between re-reading gmond.conf and resolving its hosts, or 0 for never")
 }
 
-type gmetricSample struct {
-	value interface{}
-	when  time.Time
-}
+// Reporter periodically runs its callbacks and publishes the metrics they
+// send to each of its sinks.
 type Reporter struct {
+	skipped uint64 // callback runs skipped, accessed atomically
 	*stopper.ChanStopper
+	interval  time.Duration
+	mu        sync.Mutex // guards everything below
 	prefix    string
-	callbacks []ReporterCallback
-	mu        sync.Mutex // guards previous
-	previous  map[string]gmetricSample
+	callbacks []*Callback
+	sinks     []Sink
 	groupName string
 	dmax      uint32
+	timeout   time.Duration
+
+	rounds reader // the reader for the rounds published to sinks
+}
+
+// A reader is one consumer of the metrics sent by a Reporter's callbacks:
+// the rounds it publishes to its sinks, or a PrometheusHandler. Histograms
+// in a Registry added with AddRegistry report each reader the values
+// recorded since its previous round, so that readers don't take samples
+// from each other.
+//
+// Each reader runs the callbacks separately, and a callback still running
+// from a reader's previous round is skipped by that reader alone.
+type reader struct {
+	mu      sync.Mutex
+	running map[*Callback]bool
+	late    map[*Callback][]Metric // sent after the timeout, for the next round
 }
 
 // MetricSender takes the following parameters:
@@ -77,12 +81,39 @@ type MetricSender func(name string, value string, metricType uint32, units strin
 
 type ReporterCallback func(MetricSender)
 
+// A Callback is a ReporterCallback added to a Reporter.
+type Callback struct {
+	gr *Reporter
+	fn func(MetricSender, *reader)
+}
+
+// Remove stops the Reporter from running c. A run already under way
+// finishes, but the metrics it sends may be dropped.
+func (c *Callback) Remove() {
+	if c == nil {
+		return
+	}
+	gr := c.gr
+	gr.mu.Lock()
+	defer gr.mu.Unlock()
+	for i, cb := range gr.callbacks {
+		if cb == c {
+			// copy, since collect may be ranging over the old slice
+			gr.callbacks = append(gr.callbacks[:i:i], gr.callbacks[i+1:]...)
+			return
+		}
+	}
+}
+
 // Gmetric returns a global Reporter that clients may hook into by
-// calling AddCallback.
+// calling AddCallback. It reports the metrics in DefaultRegistry to the
+// servers in GmondConfig, and exists even if GmondConfig can't be read; its
+// Health method reports why.
 func Gmetric() *Reporter {
 	globalReporter.Do(func() {
 		globalReporter.Reporter = NewGangliaReporter(Interval)
 		globalReporter.AddCallback(CommonGmetrics)
+		globalReporter.AddRegistry(DefaultRegistry)
 	})
 	return globalReporter.Reporter
 }
@@ -92,11 +123,39 @@ func (gr *Reporter) Configure(groupName, prefix string) *Reporter {
 	if gr == nil {
 		return nil
 	}
-	gr.prefix = html.EscapeString(prefix)
-	gr.groupName = html.EscapeString(groupName)
+	gr.mu.Lock()
+	defer gr.mu.Unlock()
+	gr.prefix = prefix
+	gr.groupName = groupName
+	return gr
+}
+
+// SetCallbackTimeout sets how long each round of callbacks may take, which
+// defaults to the reporting interval. Callbacks which haven't finished by
+// then are skipped: the metrics they send are held back for the next round,
+// and they aren't run again until then. SkippedCallbacks counts them.
+func (gr *Reporter) SetCallbackTimeout(timeout time.Duration) *Reporter {
+	if gr == nil {
+		return nil
+	}
+	gr.mu.Lock()
+	defer gr.mu.Unlock()
+	gr.timeout = timeout
 	return gr
 }
 
+// SkippedCallbacks returns the number of callback runs skipped because a
+// callback missed the timeout set by SetCallbackTimeout, or was still
+// running from an earlier round for the same reader. Rounds published to
+// sinks and each PrometheusHandler run callbacks separately, so they don't
+// skip callbacks on each other's account.
+func (gr *Reporter) SkippedCallbacks() uint64 {
+	if gr == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&gr.skipped)
+}
+
 // SetDmax configures the amount of time that metrics are valid for in the
 // tsdb. The default of 0 means forever. Time resolution is only respected to
 // the second.
@@ -104,6 +163,8 @@ func (gr *Reporter) SetDmax(dmax time.Duration) *Reporter {
 	if gr == nil {
 		return nil
 	}
+	gr.mu.Lock()
+	defer gr.mu.Unlock()
 	gr.dmax = uint32(dmax.Seconds())
 	return gr
 }
@@ -113,56 +174,76 @@ func (gr *Reporter) SetDmax(dmax time.Duration) *Reporter {
 //   AddGmetrics(func(gmetric MetricSender) {
 // 	   gmetric("profit", "1000000.00", GmetricFloat, "dollars", true)
 //   })
-func AddGmetrics(callback ReporterCallback) {
-	Gmetric().AddCallback(callback)
+func AddGmetrics(callback ReporterCallback) *Callback {
+	return Gmetric().AddCallback(callback)
 }
 
-func NewGmetric() (*gmetric.Gmetric, error) {
-	b, err := ioutil.ReadFile(GmondConfig)
+// NewGmetric returns a GmetricClient which sends to the udp_send_channels in
+// GmondConfig, and the files it includes. Multicast channels send to their
+// mcast_join group with their ttl and mcast_if.
+func NewGmetric() (*GmetricClient, error) {
+	conf, err := ParseGmondConf(GmondConfig)
 	if err != nil {
 		return nil, err
 	}
-	stanzas := gmondChannelRe.FindAllStringSubmatch(string(b), -1)
-	if len(stanzas) == 0 {
+	if len(conf.UDPSendChannels) == 0 {
 		return nil, fmt.Errorf("No udp_send_channel stanzas found in %s", GmondConfig)
 	}
 
-	servers := make([]gmetric.Server, 0)
-	for _, stanza := range stanzas {
-		var host, port string
-		for _, match := range gmondHostPortRe.FindAllStringSubmatch(stanza[1], 2) {
-			if match[1] == "host" {
-				host = match[2]
-			} else if match[1] == "port" {
-				port = match[2]
-			}
+	// see http://sourceforge.net/apps/trac/ganglia/wiki/gmetric_spoofing
+	hostname, _ := os.Hostname()
+	spoofName := fmt.Sprintf("%s:%s", hostname, hostname)
+
+	gm := &GmetricClient{Host: hostname, Spoof: spoofName}
+	for _, ch := range conf.UDPSendChannels {
+		servers, err := gmondServers(ch, hostname)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", ch.File, ch.Line, err)
 		}
-		if host == "" || port == "" {
-			return nil, fmt.Errorf("Missing host or port from %s stanza %q", GmondConfig, stanza[0])
+		for _, server := range servers {
+			vlog.VLogf("Reporting to Ganglia server at %s", server.Addr)
+			gm.AddServer(server)
 		}
-		portNum, err := strconv.Atoi(port)
-		if err != nil {
+	}
+	return gm, nil
+}
+
+// gmondServers returns a server for each address of ch's host.
+func gmondServers(ch UDPSendChannel, hostname string) ([]GmondServer, error) {
+	ips, err := net.LookupIP(ch.Addr())
+	if err != nil {
+		return nil, err
+	}
+	var ifi *net.Interface
+	if ch.McastIf != "" {
+		if ifi, err = net.InterfaceByName(ch.McastIf); err != nil {
 			return nil, err
 		}
-		ips, err := net.LookupIP(host)
-		if err != nil {
+	}
+	var local []net.IP
+	if ch.BindHostname {
+		if local, err = net.LookupIP(hostname); err != nil {
 			return nil, err
 		}
-		for _, ip := range ips {
-			vlog.VLogf("Reporting to Ganglia server at %s:%d", ip, portNum)
-			servers = append(servers, gmetric.Server{ip, portNum})
-		}
 	}
 
-	// see http://sourceforge.net/apps/trac/ganglia/wiki/gmetric_spoofing
-	hostname, _ := os.Hostname()
-	spoofName := fmt.Sprintf("%s:%s", hostname, hostname)
-
-	gm := gmetric.Gmetric{Spoof: spoofName}
-	for _, server := range servers {
-		gm.AddServer(server)
+	var servers []GmondServer
+	for _, ip := range ips {
+		s := GmondServer{Addr: &net.UDPAddr{IP: ip, Port: ch.Port}, TTL: ch.TTL, Interface: ifi}
+		if ch.BindHostname {
+			for _, l := range local {
+				if (l.To4() == nil) == (ip.To4() == nil) {
+					s.Bind = &net.UDPAddr{IP: l}
+					break
+				}
+			}
+			if s.Bind == nil {
+				return nil, fmt.Errorf("%s has no address to bind to for %s", hostname, ip)
+			}
+		}
+		servers = append(servers, s)
 	}
-	return &gm, nil
+	return servers, nil
 }
 
 // NewGangliaReporter returns a Reporter object which calls callback every
@@ -174,131 +255,263 @@ func NewGangliaReporter(interval time.Duration) *Reporter {
 }
 
 // NewGangliaReporterWithOptions is NewGangliaReporter with the groupName.
+// The Reporter starts even if gmond.conf can't be read, and sends metrics
+// once it can; see NewGmondSink.
 func NewGangliaReporterWithOptions(interval time.Duration, groupName string) *Reporter {
-	gm, err := NewGmetric()
-	if err != nil {
-		vlog.VLogfQuiet("ganglia", "Couldn't start Ganglia reporter: %s", err)
+	return NewReporter(interval, NewGmondSink()).Configure(groupName, "")
+}
+
+// NewReporter returns a Reporter which runs its callbacks every interval and
+// publishes the metrics they send to sinks. More sinks may be added with
+// AddSink. Calling Stop on the Reporter will cease its operation, and close
+// the sinks which implement io.Closer.
+func NewReporter(interval time.Duration, sinks ...Sink) *Reporter {
+	gr := &Reporter{
+		ChanStopper: stopper.NewChanStopper(),
+		sinks:       sinks,
+		interval:    interval,
+	}
+	go gr.run()
+	return gr
+}
+
+func (gr *Reporter) run() {
+	defer gr.Finish()
+	defer gr.closeSinks()
+	// ticks are dropped while a round is still being published
+	ticker := time.NewTicker(gr.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-gr.Chan:
+			return
+		case <-ticker.C:
+			gr.publish(gr.collect(&gr.rounds))
+		}
+	}
+}
+
+// collect runs the callbacks for rd and returns the metrics they send, in
+// the order the callbacks were added. Each callback runs in its own
+// goroutine, so that collect can give up on those still running at the
+// timeout. What they send once they finish is returned by rd's next round
+// instead of running them again.
+func (gr *Reporter) collect(rd *reader) *Batch {
+	gr.mu.Lock()
+	b := &Batch{
+		Prefix:   gr.prefix,
+		Group:    gr.groupName,
+		Interval: gr.interval,
+		Dmax:     time.Duration(gr.dmax) * time.Second,
+		Time:     time.Now(),
+	}
+	callbacks := append([]*Callback(nil), gr.callbacks...)
+	timeout := gr.timeout
+	gr.mu.Unlock()
+	if timeout <= 0 {
+		timeout = gr.interval
+	}
+
+	type result struct {
+		i       int
+		metrics []Metric
+	}
+	sent := make([][]Metric, len(callbacks))
+	run := make([]bool, len(callbacks))
+	skipped := 0
+	rd.mu.Lock()
+	if rd.running == nil {
+		rd.running = make(map[*Callback]bool)
+	}
+	for i, cb := range callbacks {
+		var late bool
+		if sent[i], late = rd.late[cb]; late {
+			continue
+		}
+		if rd.running[cb] {
+			skipped++
+			continue
+		}
+		rd.running[cb], run[i] = true, true
+	}
+	rd.late = nil
+	rd.mu.Unlock()
+	if skipped > 0 {
+		atomic.AddUint64(&gr.skipped, uint64(skipped))
+	}
+
+	results := make(chan result, len(callbacks))
+	timedOut := false // guarded by rd.mu
+	pending := 0
+	for i, cb := range callbacks {
+		if !run[i] {
+			continue
+		}
+		pending++
+		go func(i int, cb *Callback) {
+			var metrics []Metric
+			cb.fn(func(name string, value string, metricType uint32, units string, rate bool) {
+				metrics = append(metrics, Metric{name, value, metricType, units, rate})
+			}, rd)
+			rd.mu.Lock()
+			delete(rd.running, cb)
+			if timedOut {
+				if rd.late == nil {
+					rd.late = make(map[*Callback][]Metric)
+				}
+				rd.late[cb] = metrics
+			} else {
+				results <- result{i, metrics}
+			}
+			rd.mu.Unlock()
+		}(i, cb)
+	}
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+wait:
+	for ; pending > 0; pending-- {
+		select {
+		case r := <-results:
+			sent[r.i] = r.metrics
+		case <-deadline.C:
+			rd.mu.Lock()
+			timedOut = true
+			rd.mu.Unlock()
+			// no more results are sent, but some may have been meanwhile
+			for ; len(results) > 0; pending-- {
+				r := <-results
+				sent[r.i] = r.metrics
+			}
+			if pending == 0 {
+				break wait
+			}
+			atomic.AddUint64(&gr.skipped, uint64(pending))
+			vlog.VLogfQuiet("ganglia callbacks", "Skipping %d Ganglia callbacks still running after %s", pending, timeout)
+			break wait
+		}
+	}
+	for _, metrics := range sent {
+		b.Metrics = append(b.Metrics, metrics...)
+	}
+	return b
+}
+
+// closeSinks closes those of gr's sinks which are io.Closers, once gr has
+// stopped.
+func (gr *Reporter) closeSinks() {
+	gr.mu.Lock()
+	sinks := append([]Sink(nil), gr.sinks...)
+	gr.mu.Unlock()
+	for _, sink := range sinks {
+		if c, ok := sink.(io.Closer); ok {
+			if err := c.Close(); err != nil {
+				vlog.VLogf("Closing %T: %s", sink, err)
+			}
+		}
+	}
+}
+
+// publish sends b to each of the sinks at once, and waits for them to finish.
+func (gr *Reporter) publish(b *Batch) {
+	gr.mu.Lock()
+	sinks := append([]Sink(nil), gr.sinks...)
+	gr.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, sink := range sinks {
+		wg.Add(1)
+		go func(sink Sink) {
+			defer wg.Done()
+			if err := sink.Publish(b); err != nil {
+				vlog.VLogfQuiet(fmt.Sprintf("sink %T", sink), "Couldn't publish metrics to %T: %s", sink, err)
+			}
+		}(sink)
+	}
+	wg.Wait()
+}
+
+// AddSink adds another destination for the metrics gr collects.
+func (gr *Reporter) AddSink(sink Sink) {
+	if gr == nil {
+		return
+	}
+	gr.mu.Lock()
+	defer gr.mu.Unlock()
+	gr.sinks = append(gr.sinks, sink)
+}
+
+// AddCallback adds a callback to run every interval, and returns a handle
+// which removes it again. A callback may also be run by a PrometheusHandler,
+// at the same time as a round, so it must be safe for concurrent use.
+func (gr *Reporter) AddCallback(callback ReporterCallback) *Callback {
+	if gr == nil {
 		return nil
-	} else if gm == nil {
+	}
+	return gr.addCallback(func(gmetric MetricSender, _ *reader) { callback(gmetric) })
+}
+
+// AddRegistry adds a callback which reports the metrics in r, as r.Report
+// does, except that histograms report each reader of gr, such as its sinks
+// and each PrometheusHandler, the values recorded since that reader's
+// previous round.
+func (gr *Reporter) AddRegistry(r *Registry) *Callback {
+	if gr == nil {
 		return nil
 	}
-	stopper := stopper.NewChanStopper()
-	gr := &Reporter{
-		ChanStopper: stopper,
-		prefix:      "",
-		callbacks:   []ReporterCallback{},
-		previous:    make(map[string]gmetricSample),
-		groupName:   groupName,
-		dmax:        0,
-	}
-	go func() {
-		defer stopper.Done()
-		for {
-			select {
-			case <-stopper.Chan:
-				return
-			case <-time.After(interval):
-				go func() {
-					// SendMetric "opens" and "closes" UDP connections each
-					// time, but since we expect the callback to send several
-					// metrics at once, avoid that here.
-					conns := gm.OpenConnections()
-					n := 0
-					sender := func(name string, value string, metricType uint32, units string, rate bool) {
-						v := value
-						if rate {
-							gr.mu.Lock()
-							defer gr.mu.Unlock()
-							prev, exists := gr.previous[name]
-							units += "/sec"
-
-							now := time.Now()
-
-							switch metricType {
-							case Ushort, Short, Uint, Int:
-								i, err := strconv.Atoi(value)
-								if err != nil {
-									vlog.VLogfQuiet(name, "Value %q doesn't look like an int: %s", value, err)
-									return
-								}
-								gr.previous[name] = gmetricSample{i, now}
-								if !exists {
-									return
-								}
-								delta := i - prev.value.(int)
-								elapsed := time.Now().Sub(prev.when).Seconds()
-								v = fmt.Sprint(float64(delta) / elapsed)
-								// upgrade to a float to avoid loss of precision
-								metricType = Float
-
-							case Float, Double:
-								f, err := strconv.ParseFloat(value, 64)
-								if err != nil {
-									vlog.VLogfQuiet(name, "Value %q doesn't look like a float: %s", value, err)
-									return
-								}
-								gr.previous[name] = gmetricSample{f, now}
-								if !exists {
-									return
-								}
-								delta := f - prev.value.(float64)
-								elapsed := time.Now().Sub(prev.when).Seconds()
-								v = fmt.Sprint(delta / elapsed)
-
-							case String:
-								vlog.VLogfQuiet(name, "Can't compute deltas for string metric %q", value)
-								return
-							}
-						}
-
-						// gmetad fails to escape quotes, eventually generating
-						// invalid xml. do it here as a workaround.
-						v = html.EscapeString(v)
-						name = html.EscapeString(name)
-						units = html.EscapeString(units)
-
-						n++
-						gm.SendMetricPackets(
-							gr.prefix+name, v, metricType, units,
-							gmetric.SLOPE_BOTH,
-							uint32(interval.Seconds()), // tmax is the expected reporting interval
-							gr.dmax,
-							gr.groupName,
-							gmetric.PACKET_BOTH, conns,
-						)
-						if debug.On() {
-							if rate {
-								log.Printf("gmetric: name=%q, rate=%q, value=%q, type=%d, units=%q, slope=%d, tmax=%d, dmax=%v, group=%q, packet=%d",
-									gr.prefix+name, v, value, metricType, units, gmetric.SLOPE_BOTH,
-									uint32(interval.Seconds()), gr.dmax, gr.groupName, gmetric.PACKET_BOTH,
-								)
-							} else {
-								log.Printf("gmetric: name=%q, value=%q, type=%d, units=%q, slope=%d, tmax=%d, dmax=%v, group=%q, packet=%d",
-									gr.prefix+name, v, metricType, units, gmetric.SLOPE_BOTH,
-									uint32(interval.Seconds()), gr.dmax, gr.groupName, gmetric.PACKET_BOTH,
-								)
-							}
-						}
-					}
-					defer gm.CloseConnections(conns)
-					for _, callback := range gr.callbacks {
-						callback(sender)
-					}
-					if debug.On() {
-						log.Printf("Published %d metrics to Ganglia", n)
-					}
-				}()
+	return gr.addCallback(r.report)
+}
+
+func (gr *Reporter) addCallback(fn func(MetricSender, *reader)) *Callback {
+	c := &Callback{gr: gr, fn: fn}
+	gr.mu.Lock()
+	defer gr.mu.Unlock()
+	gr.callbacks = append(gr.callbacks, c)
+	return c
+}
+
+// Health returns the first error from the Health methods of gr's sinks,
+// such as a GangliaSink which can't read gmond.conf, or nil if they're all
+// healthy. It can be registered with lifecycle's AddHealthCheck.
+func (gr *Reporter) Health() error {
+	if gr == nil {
+		return nil
+	}
+	gr.mu.Lock()
+	sinks := append([]Sink(nil), gr.sinks...)
+	gr.mu.Unlock()
+	for _, sink := range sinks {
+		if h, ok := sink.(interface {
+			Health() error
+		}); ok {
+			if err := h.Health(); err != nil {
+				return err
 			}
 		}
-	}()
-	return gr
+	}
+	return nil
 }
 
-func (gr *Reporter) AddCallback(callback ReporterCallback) {
+// Reload calls the Reload methods of gr's sinks, such as a GangliaSink
+// re-reading gmond.conf, and returns the first error.
+func (gr *Reporter) Reload() error {
 	if gr == nil {
-		return
+		return nil
 	}
-	gr.callbacks = append(gr.callbacks, callback)
+	gr.mu.Lock()
+	sinks := append([]Sink(nil), gr.sinks...)
+	gr.mu.Unlock()
+	var firstErr error
+	for _, sink := range sinks {
+		if r, ok := sink.(interface {
+			Reload() error
+		}); ok {
+			if err := r.Reload(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
 }
 
 func (g *Reporter) Stop() {
@@ -308,13 +521,183 @@ func (g *Reporter) Stop() {
 	g.ChanStopper.Stop()
 }
 
+// bounds on the delay between attempts to load gmond.conf after a failure
+const (
+	minReloadBackoff = time.Second
+	maxReloadBackoff = 5 * time.Minute
+)
+
+// GangliaSink publishes metrics to gmond servers.
+type GangliaSink struct {
+	rates rateTracker
+	load  func() (*GmetricClient, error) // nil if gm is fixed
+	every time.Duration                   // between reloads, or 0 for never
+
+	sendMu  sync.Mutex // serializes loading and sending; guards below
+	gm      *GmetricClient
+	next    time.Time // time of the next reload, or zero for none
+	backoff time.Duration
+
+	mu      sync.Mutex // guards below
+	loadErr error      // from the last load
+	sendErr error      // from the last Publish
+}
+
+// NewGangliaSink returns a Sink which sends metrics with gm.
+func NewGangliaSink(gm *GmetricClient) *GangliaSink {
+	return &GangliaSink{gm: gm}
+}
+
+// NewGmondSink returns a Sink which sends metrics to the servers configured
+// in GmondConfig. It re-reads GmondConfig and resolves its hosts again every
+// ReloadInterval, or when Reload is called. If that fails, it keeps sending
+// to the servers it had, and retries with exponential backoff; if it has
+// none yet, metrics are dropped meanwhile. Health reports the failure.
+func NewGmondSink() *GangliaSink {
+	s := &GangliaSink{load: NewGmetric, every: ReloadInterval}
+	if err := s.Reload(); err != nil {
+		vlog.VLogfQuiet("ganglia", "Couldn't load Ganglia config, will retry: %s", err)
+	}
+	return s
+}
+
+// Reload re-reads GmondConfig and resolves its hosts again, if s was
+// returned by NewGmondSink.
+func (s *GangliaSink) Reload() error {
+	if s.load == nil {
+		return nil
+	}
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	return s.reload(time.Now())
+}
+
+// reload loads a new GmetricClient. s.sendMu must be held.
+func (s *GangliaSink) reload(now time.Time) error {
+	gm, err := s.load()
+	s.mu.Lock()
+	s.loadErr = err
+	s.mu.Unlock()
+	if err != nil {
+		s.backoff *= 2
+		if s.backoff < minReloadBackoff {
+			s.backoff = minReloadBackoff
+		} else if s.backoff > maxReloadBackoff {
+			s.backoff = maxReloadBackoff
+		}
+		s.next = now.Add(s.backoff)
+		return err
+	}
+	if s.gm != nil {
+		s.gm.Close()
+	}
+	s.gm, s.backoff, s.next = gm, 0, time.Time{}
+	if s.every > 0 {
+		s.next = now.Add(s.every)
+	}
+	return nil
+}
+
+// Health returns the error from the last attempt to load GmondConfig, or
+// else from the last Publish, or nil if both succeeded.
+func (s *GangliaSink) Health() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.loadErr != nil {
+		return s.loadErr
+	}
+	return s.sendErr
+}
+
+// Publish sends b's metrics, and returns the first error from sending them.
+// gm's connections stay open for the next batch.
+func (s *GangliaSink) Publish(b *Batch) error {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	if s.load != nil && !s.next.IsZero() && !b.Time.Before(s.next) {
+		if err := s.reload(b.Time); err != nil {
+			vlog.VLogfQuiet("ganglia", "Couldn't reload Ganglia config: %s", err)
+		}
+	}
+	err := s.publish(b)
+	s.mu.Lock()
+	s.sendErr = err
+	s.mu.Unlock()
+	return err
+}
+
+func (s *GangliaSink) publish(b *Batch) error {
+	if s.gm == nil {
+		return fmt.Errorf("no gmond servers loaded from %s", GmondConfig)
+	}
+
+	// gmetad fails to escape quotes, eventually generating invalid xml. do
+	// it here as a workaround.
+	prefix := html.EscapeString(b.Prefix)
+	group := html.EscapeString(b.Group)
+	tmax := uint32(b.Interval.Seconds()) // tmax is the expected reporting interval
+	dmax := uint32(b.Dmax.Seconds())
+
+	n := 0
+	var firstErr error
+	for _, m := range b.Metrics {
+		value, metricType, units := m.Value, m.Type, m.Units
+		if m.Rate {
+			r, ok := s.rates.rate(m, b.Time)
+			if !ok {
+				continue
+			}
+			value, metricType, units = r.Value, r.Type, r.Units
+		}
+		value = html.EscapeString(value)
+		name := html.EscapeString(m.Name)
+		units = html.EscapeString(units)
+
+		if err := s.gm.SendMetric(prefix+name, value, metricType, units, tmax, dmax, group); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		n++
+		if debug.On() {
+			if m.Rate {
+				log.Printf("gmetric: name=%q, rate=%q, value=%q, type=%d, units=%q, slope=%d, tmax=%d, dmax=%v, group=%q",
+					prefix+name, value, m.Value, metricType, units, slopeBoth,
+					tmax, dmax, group,
+				)
+			} else {
+				log.Printf("gmetric: name=%q, value=%q, type=%d, units=%q, slope=%d, tmax=%d, dmax=%v, group=%q",
+					prefix+name, value, metricType, units, slopeBoth,
+					tmax, dmax, group,
+				)
+			}
+		}
+	}
+	if debug.On() {
+		log.Printf("Published %d metrics to Ganglia", n)
+	}
+	return firstErr
+}
+
+// Close closes the connections to the gmond servers.
+func (s *GangliaSink) Close() error {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	if s.gm == nil {
+		return nil
+	}
+	return s.gm.Close()
+}
+
 func CommonGmetrics(gmetric MetricSender) {
 	gmetric("goroutines", fmt.Sprintf("%d", runtime.NumGoroutine()), Uint, "num", false)
 
 	var mem runtime.MemStats
 	runtime.ReadMemStats(&mem)
-	gmetric("mem_alloc", fmt.Sprintf("%d", mem.Alloc), Uint, "bytes", false)
-	gmetric("mem_sys", fmt.Sprintf("%d", mem.Sys), Uint, "bytes", false)
+	// doubles, since a uint32 would overflow at 4GiB
+	gmetric("mem_alloc", fmt.Sprintf("%d", mem.Alloc), Double, "bytes", false)
+	gmetric("mem_sys", fmt.Sprintf("%d", mem.Sys), Double, "bytes", false)
 	gmetric("mem_gc_pause_last", fmt.Sprintf("%.6f", float64(mem.PauseNs[(mem.NumGC+255)%256])/1e6), Float, "ms", false)
 	var gcPauseMax uint64
 	for _, v := range mem.PauseNs {
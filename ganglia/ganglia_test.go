@@ -0,0 +1,252 @@
+package ganglia
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func metricNames(b *Batch) []string {
+	var names []string
+	for _, m := range b.Metrics {
+		names = append(names, m.Name)
+	}
+	return names
+}
+
+func TestCallbackRemove(t *testing.T) {
+	gr := NewReporter(time.Hour)
+	defer gr.Stop()
+	a := gr.AddCallback(func(gmetric MetricSender) { gmetric("a", "1", Uint, "", false) })
+	gr.AddCallback(func(gmetric MetricSender) { gmetric("b", "1", Uint, "", false) })
+	gr.AddCallback(func(gmetric MetricSender) { gmetric("c", "1", Uint, "", false) })
+
+	if names := metricNames(gr.collect(&gr.rounds)); len(names) != 3 || names[0] != "a" || names[2] != "c" {
+		t.Errorf("got metrics %q, expected a, b and c in order", names)
+	}
+	a.Remove()
+	a.Remove()
+	if names := metricNames(gr.collect(&gr.rounds)); len(names) != 2 || names[0] != "b" {
+		t.Errorf("got metrics %q after removing a, expected b and c", names)
+	}
+
+	// adding and removing callbacks while collecting is safe
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			gr.AddCallback(func(MetricSender) {}).Remove()
+		}()
+		go func() {
+			defer wg.Done()
+			gr.collect(&gr.rounds)
+		}()
+	}
+	wg.Wait()
+}
+
+func TestCallbackTimeout(t *testing.T) {
+	gr := NewReporter(time.Hour).SetCallbackTimeout(20 * time.Millisecond)
+	defer gr.Stop()
+	release := make(chan struct{})
+	var runs int32
+	gr.AddCallback(func(gmetric MetricSender) {
+		atomic.AddInt32(&runs, 1)
+		<-release
+		gmetric("slow", "1", Uint, "", false)
+	})
+	gr.AddCallback(func(gmetric MetricSender) { gmetric("fast", "1", Uint, "", false) })
+
+	for i := 1; i <= 3; i++ {
+		start := time.Now()
+		if names := metricNames(gr.collect(&gr.rounds)); len(names) != 1 || names[0] != "fast" {
+			t.Errorf("got metrics %q while the slow callback runs, expected only fast", names)
+		}
+		if d := time.Since(start); d > time.Second {
+			t.Errorf("collect took %s with a 20ms timeout", d)
+		}
+		if n := gr.SkippedCallbacks(); n != uint64(i) {
+			t.Errorf("got %d skipped callbacks after %d rounds, expected %d", n, i, i)
+		}
+	}
+	if n := atomic.LoadInt32(&runs); n != 1 {
+		t.Errorf("slow callback started %d times, expected it not to be run again until it finished", n)
+	}
+
+	// what the slow callback sends once it finishes comes with the next
+	// round, rather than being dropped
+	close(release)
+	deadline := time.Now().Add(time.Second)
+	for len(gr.collect(&gr.rounds).Metrics) != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("metrics from the slow callback weren't sent after it finished")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&runs); n != 1 {
+		t.Errorf("slow callback started %d times, expected its late metrics to be sent instead", n)
+	}
+	if names := metricNames(gr.collect(&gr.rounds)); len(names) != 2 {
+		t.Errorf("got metrics %q in the following round, expected both callbacks to run", names)
+	}
+}
+
+func TestCallbackReaders(t *testing.T) {
+	gr := NewReporter(time.Hour).SetCallbackTimeout(time.Second)
+	defer gr.Stop()
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+	gr.AddCallback(func(gmetric MetricSender) {
+		started <- struct{}{}
+		<-release
+		gmetric("slow", "1", Uint, "", false)
+	})
+
+	// a scrape during a round runs the callback itself rather than
+	// skipping it, and the round still gets its own metrics
+	round := make(chan *Batch)
+	go func() { round <- gr.collect(&gr.rounds) }()
+	<-started
+	scraped := make(chan string)
+	go func() {
+		w := httptest.NewRecorder()
+		gr.PrometheusHandler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+		scraped <- w.Body.String()
+	}()
+	<-started
+	close(release)
+	if body := <-scraped; !strings.Contains(body, "slow 1\n") {
+		t.Errorf("scrape during a round didn't run the callback:\n%s", body)
+	}
+	if names := metricNames(<-round); len(names) != 1 || names[0] != "slow" {
+		t.Errorf("got metrics %q from the round, expected slow", names)
+	}
+	if n := gr.SkippedCallbacks(); n != 0 {
+		t.Errorf("got %d skipped callbacks, expected none", n)
+	}
+}
+
+func TestGangliaReporterWithoutConfig(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	dir, err := ioutil.TempDir("", "gmondconf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(orig string) { GmondConfig = orig }(GmondConfig)
+	GmondConfig = filepath.Join(dir, "gmond.conf")
+
+	gr := NewGangliaReporterWithOptions(time.Hour, "")
+	if gr == nil {
+		t.Fatal("got no reporter without gmond.conf")
+	}
+	defer gr.Stop()
+	if err := gr.Health(); err == nil || !os.IsNotExist(err) {
+		t.Errorf("got health %v without gmond.conf, expected a missing file", err)
+	}
+	b := &Batch{Time: time.Now(), Metrics: []Metric{{Name: "reqs", Value: "42", Type: Uint, Units: "num"}}}
+	gr.publish(b)
+
+	writeConf(t, dir, map[string]string{"gmond.conf": fmt.Sprintf("udp_send_channel {\n host = 127.0.0.1\n port = %d\n}\n",
+		conn.LocalAddr().(*net.UDPAddr).Port)})
+	if err := gr.Reload(); err != nil {
+		t.Fatalf("Reload: %s", err)
+	}
+	gr.publish(b)
+	if err := gr.Health(); err != nil {
+		t.Errorf("got health %v after reloading", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := conn.ReadFrom(make([]byte, 1500)); err != nil {
+		t.Errorf("got no packets after reloading: %s", err)
+	}
+}
+
+func TestGangliaSinkReloadBackoff(t *testing.T) {
+	var loads int
+	var loadErr error
+	s := &GangliaSink{every: time.Minute, load: func() (*GmetricClient, error) {
+		loads++
+		if loadErr != nil {
+			return nil, loadErr
+		}
+		return &GmetricClient{}, nil
+	}}
+	if err := s.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	now := s.next.Add(-s.every)
+	publish := func(after time.Duration) {
+		s.Publish(&Batch{Time: now.Add(after)})
+	}
+	gm := s.gm
+	publish(59 * time.Second)
+	if loads != 1 {
+		t.Errorf("reloaded before the reload interval")
+	}
+
+	// a failed reload keeps the old servers and backs off
+	loadErr = errors.New("no such host")
+	for i, after := range []time.Duration{time.Minute, time.Minute + time.Second, time.Minute + 3*time.Second} {
+		publish(after)
+		if loads != i+2 {
+			t.Errorf("got %d loads by %s, expected %d", loads, after, i+2)
+		}
+		publish(after + time.Second/2)
+		if loads != i+2 {
+			t.Errorf("reloaded within the backoff at %s", after+time.Second/2)
+		}
+	}
+	if s.gm != gm {
+		t.Errorf("a failed reload replaced the servers")
+	}
+	if err := s.Health(); err != loadErr {
+		t.Errorf("got health %v, expected %v", err, loadErr)
+	}
+
+	loadErr = nil
+	publish(time.Minute + 7*time.Second)
+	if s.gm == gm || s.Health() != nil || s.backoff != 0 {
+		t.Errorf("a successful reload didn't replace the servers and clear the error")
+	}
+}
+
+type closingSink struct {
+	MemorySink
+	closed int32
+}
+
+func (s *closingSink) Close() error {
+	atomic.AddInt32(&s.closed, 1)
+	return nil
+}
+
+func TestReporterStopClosesSinks(t *testing.T) {
+	closer, other := new(closingSink), new(MemorySink)
+	gr := NewReporter(time.Hour, closer, other)
+	stopped := make(chan struct{})
+	gr.OnDone(func() { close(stopped) })
+	gr.Stop()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("reporter didn't stop")
+	}
+	if n := atomic.LoadInt32(&closer.closed); n != 1 {
+		t.Errorf("sink closed %d times after Stop, expected once", n)
+	}
+}
@@ -0,0 +1,344 @@
+package ganglia
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"github.com/fastly/go-utils/vlog"
+)
+
+// Value types of metrics, as in gmond's Ganglia_value_types.
+const (
+	String = iota + 1
+	Ushort
+	Short
+	Uint
+	Int
+	Float
+	Double
+)
+
+// slopes, as in gmond's Ganglia_slope_t
+const (
+	slopeZero = iota
+	slopePositive
+	slopeNegative
+	slopeBoth
+)
+
+// packet ids, as in gmond's Ganglia_msg_formats
+const (
+	msgMetadata = 128 + iota
+	msgUshort
+	msgShort
+	msgInt
+	msgUint
+	msgString
+	msgFloat
+	msgDouble
+)
+
+// gmetricTypes describes how values of each type are sent.
+var gmetricTypes = map[uint32]struct {
+	name, format string
+	msg          uint32
+	bits         int // size of numeric values
+}{
+	String: {"string", "%s", msgString, 0},
+	Ushort: {"uint16", "%hu", msgUshort, 16},
+	Short:  {"int16", "%hd", msgShort, 16},
+	Uint:   {"uint32", "%u", msgUint, 32},
+	Int:    {"int32", "%d", msgInt, 32},
+	Float:  {"float", "%f", msgFloat, 32},
+	Double: {"double", "%f", msgDouble, 64},
+}
+
+// A GmondServer is a gmond which metrics are sent to.
+type GmondServer struct {
+	Addr *net.UDPAddr
+	// TTL and Interface apply when Addr is a multicast group. TTL is the
+	// time to live of packets, 1 if zero, and Interface the one to send
+	// them from, if not the default.
+	TTL       int
+	Interface *net.Interface
+	// Bind, if set, is the local address packets are sent from.
+	Bind *net.UDPAddr
+}
+
+// GmetricClient sends metrics to gmond servers in gmond's XDR wire format. It
+// keeps a connection to each server open between calls to SendMetric, and
+// is safe for concurrent use.
+type GmetricClient struct {
+	Servers []GmondServer
+	// Host is the host metrics are reported for. If empty, it's the local
+	// hostname.
+	Host string
+	// Spoof, if set, is the "ip:hostname" metrics are reported as coming
+	// from instead of Host.
+	Spoof string
+
+	mu    sync.Mutex
+	conns []*net.UDPConn // by server, nil until opened
+}
+
+// AddServer adds a server to send metrics to.
+func (g *GmetricClient) AddServer(s GmondServer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.Servers = append(g.Servers, s)
+}
+
+// SendMetric sends a metadata and a value packet for a metric to each
+// server. value is parsed according to metricType, one of String, Ushort,
+// Short, Uint, Int, Float or Double. tmax is the expected interval between
+// values, and dmax how long the metric is kept without one, 0 meaning
+// forever. group, if set, is the metric's group. A numeric value too large
+// for metricType is sent as a String, rather than not at all.
+func (g *GmetricClient) SendMetric(name, value string, metricType uint32, units string, tmax, dmax uint32, group string) error {
+	host, spoof := g.Spoof, true
+	if host == "" {
+		host, spoof = g.Host, false
+		if host == "" {
+			host, _ = os.Hostname()
+		}
+	}
+	var extra [][2]string
+	if group != "" {
+		extra = append(extra, [2]string{"GROUP", group})
+	}
+	if spoof {
+		extra = append(extra, [2]string{"SPOOF_HOST", host})
+	}
+	val, err := encodeValue(host, spoof, name, value, metricType)
+	if errors.Is(err, strconv.ErrRange) {
+		vlog.VLogfQuiet(name, "Sending %s as a string: %s", name, err)
+		metricType = String
+		val, err = encodeValue(host, spoof, name, value, metricType)
+	}
+	if err != nil {
+		return err
+	}
+	meta, err := encodeMetadata(host, spoof, name, units, metricType, slopeBoth, tmax, dmax, extra)
+	if err != nil {
+		return err
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var firstErr error
+	for i := range g.Servers {
+		if err := g.write(i, meta, val); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// write sends packets to server i, opening a connection to it if needed.
+// After an error the connection is closed, to be reopened by the next
+// write. g.mu must be held.
+func (g *GmetricClient) write(i int, packets ...[]byte) error {
+	for len(g.conns) < len(g.Servers) {
+		g.conns = append(g.conns, nil)
+	}
+	if g.conns[i] == nil {
+		c, err := dialGmond(g.Servers[i])
+		if err != nil {
+			return err
+		}
+		g.conns[i] = c
+	}
+	for _, p := range packets {
+		if _, err := g.conns[i].Write(p); err != nil {
+			g.conns[i].Close()
+			g.conns[i] = nil
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes the connections to the servers. Sending more metrics opens
+// them again.
+func (g *GmetricClient) Close() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var firstErr error
+	for i, c := range g.conns {
+		if c == nil {
+			continue
+		}
+		if err := c.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		g.conns[i] = nil
+	}
+	return firstErr
+}
+
+func dialGmond(s GmondServer) (*net.UDPConn, error) {
+	c, err := net.DialUDP("udp", s.Bind, s.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if s.Addr.IP.IsMulticast() {
+		if err := setMulticastOptions(c, s); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("setting multicast options for %s: %s", s.Addr, err)
+		}
+	}
+	return c, nil
+}
+
+func setMulticastOptions(c *net.UDPConn, s GmondServer) error {
+	ttl := s.TTL
+	if ttl == 0 {
+		ttl = 1
+	}
+	var ifaddr [4]byte
+	if s.Interface != nil && s.Addr.IP.To4() != nil {
+		addrs, err := s.Interface.Addrs()
+		if err != nil {
+			return err
+		}
+		found := false
+		for _, a := range addrs {
+			if n, ok := a.(*net.IPNet); ok && n.IP.To4() != nil {
+				copy(ifaddr[:], n.IP.To4())
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("interface %s has no IPv4 address", s.Interface.Name)
+		}
+	}
+
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		if s.Addr.IP.To4() != nil {
+			serr = syscall.SetsockoptByte(int(fd), syscall.IPPROTO_IP, syscall.IP_MULTICAST_TTL, byte(ttl))
+			if serr == nil && s.Interface != nil {
+				serr = syscall.SetsockoptInet4Addr(int(fd), syscall.IPPROTO_IP, syscall.IP_MULTICAST_IF, ifaddr)
+			}
+			return
+		}
+		serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_HOPS, ttl)
+		if serr == nil && s.Interface != nil {
+			serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_IF, s.Interface.Index)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// xdrWriter encodes values as in RFC 4506.
+type xdrWriter struct {
+	bytes.Buffer
+}
+
+func (w *xdrWriter) uint32(v uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	w.Write(b[:])
+}
+
+func (w *xdrWriter) bool(v bool) {
+	if v {
+		w.uint32(1)
+	} else {
+		w.uint32(0)
+	}
+}
+
+func (w *xdrWriter) string(s string) {
+	w.uint32(uint32(len(s)))
+	w.WriteString(s)
+	for i := len(s); i%4 != 0; i++ {
+		w.WriteByte(0)
+	}
+}
+
+// metricID writes the Ganglia_metric_id which starts each packet.
+func (w *xdrWriter) metricID(msg uint32, host, name string, spoof bool) {
+	w.uint32(msg)
+	w.string(host)
+	w.string(name)
+	w.bool(spoof)
+}
+
+// encodeMetadata returns a metadata packet describing a metric. extra holds
+// key-value pairs such as the metric's GROUP.
+func encodeMetadata(host string, spoof bool, name, units string, metricType, slope, tmax, dmax uint32, extra [][2]string) ([]byte, error) {
+	t, ok := gmetricTypes[metricType]
+	if !ok {
+		return nil, fmt.Errorf("gmetric: unknown type %d for %s", metricType, name)
+	}
+	var w xdrWriter
+	w.metricID(msgMetadata, host, name, spoof)
+	w.string(t.name)
+	w.string(name)
+	w.string(units)
+	w.uint32(slope)
+	w.uint32(tmax)
+	w.uint32(dmax)
+	w.uint32(uint32(len(extra)))
+	for _, kv := range extra {
+		w.string(kv[0])
+		w.string(kv[1])
+	}
+	return w.Bytes(), nil
+}
+
+// encodeValue returns a value packet for a metric, with value parsed
+// according to metricType.
+func encodeValue(host string, spoof bool, name, value string, metricType uint32) ([]byte, error) {
+	t, ok := gmetricTypes[metricType]
+	if !ok {
+		return nil, fmt.Errorf("gmetric: unknown type %d for %s", metricType, name)
+	}
+	var w xdrWriter
+	w.metricID(t.msg, host, name, spoof)
+	w.string(t.format)
+	var err error
+	switch metricType {
+	case String:
+		w.string(value)
+	case Ushort, Uint:
+		var v uint64
+		v, err = strconv.ParseUint(value, 10, t.bits)
+		w.uint32(uint32(v))
+	case Short, Int:
+		var v int64
+		v, err = strconv.ParseInt(value, 10, t.bits)
+		w.uint32(uint32(int32(v)))
+	case Float:
+		var v float64
+		v, err = strconv.ParseFloat(value, 32)
+		w.uint32(math.Float32bits(float32(v)))
+	case Double:
+		var v float64
+		v, err = strconv.ParseFloat(value, 64)
+		bits := math.Float64bits(v)
+		w.uint32(uint32(bits >> 32))
+		w.uint32(uint32(bits))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("gmetric: bad %s value for %s: %w", t.name, name, err)
+	}
+	return w.Bytes(), nil
+}
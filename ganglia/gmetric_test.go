@@ -0,0 +1,194 @@
+package ganglia
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(strings.Join(strings.Fields(s), ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// golden packets for a uint32 metric "reqs" of 42 "num" from host "web1"
+// in group "app", with tmax 9
+const (
+	goldenMetadata = `
+		00000080
+		00000004 77656231
+		00000004 72657173
+		00000000
+		00000006 75696e74 33320000
+		00000004 72657173
+		00000003 6e756d00
+		00000003
+		00000009
+		00000000
+		00000001
+		00000005 47524f55 50000000 00000003 61707000`
+	goldenValue = `
+		00000084
+		00000004 77656231
+		00000004 72657173
+		00000000
+		00000002 25750000
+		0000002a`
+)
+
+func TestGmetricGoldenPackets(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	gm := &GmetricClient{Host: "web1"}
+	gm.AddServer(GmondServer{Addr: conn.LocalAddr().(*net.UDPAddr)})
+	defer gm.Close()
+
+	var source net.Addr
+	b := make([]byte, 1500)
+	for i := 0; i < 2; i++ {
+		if err := gm.SendMetric("reqs", "42", Uint, "num", 9, 0, "app"); err != nil {
+			t.Fatalf("SendMetric: %s", err)
+		}
+		for _, golden := range []string{goldenMetadata, goldenValue} {
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			n, from, err := conn.ReadFrom(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expected := unhex(t, golden); !bytes.Equal(b[:n], expected) {
+				t.Errorf("got packet\n%s\nexpected\n%s", hex.Dump(b[:n]), hex.Dump(expected))
+			}
+			if source == nil {
+				source = from
+			} else if from.String() != source.String() {
+				t.Errorf("got packet from %s, expected the connection from %s to be reused", from, source)
+			}
+		}
+	}
+}
+
+func TestGmetricSpoof(t *testing.T) {
+	meta, err := encodeMetadata("10.0.0.1:web1", true, "x", "", String, slopeBoth, 0, 0, [][2]string{{"SPOOF_HOST", "10.0.0.1:web1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := unhex(t, `
+		00000080
+		0000000d 31302e30 2e302e31 3a776562 31000000
+		00000001 78000000
+		00000001
+		00000006 73747269 6e670000
+		00000001 78000000
+		00000000
+		00000003
+		00000000
+		00000000
+		00000001
+		0000000a 53504f4f 465f484f 53540000 0000000d 31302e30 2e302e31 3a776562 31000000`)
+	if !bytes.Equal(meta, expected) {
+		t.Errorf("got packet\n%s\nexpected\n%s", hex.Dump(meta), hex.Dump(expected))
+	}
+}
+
+func TestGmetricValueTypes(t *testing.T) {
+	for _, test := range []struct {
+		metricType uint32
+		value      string
+		msg        uint32
+		encoded    string // format and value
+	}{
+		{String, "ok", msgString, "00000002 25730000 00000002 6f6b0000"},
+		{Ushort, "65535", msgUshort, "00000003 25687500 0000ffff"},
+		{Short, "-1", msgShort, "00000003 25686400 ffffffff"},
+		{Uint, "4294967295", msgUint, "00000002 25750000 ffffffff"},
+		{Int, "-2", msgInt, "00000002 25640000 fffffffe"},
+		{Float, "1.5", msgFloat, "00000002 25660000 3fc00000"},
+		{Double, "1.5", msgDouble, "00000002 25660000 3ff80000 00000000"},
+	} {
+		p, err := encodeValue("h", false, "m", test.value, test.metricType)
+		if err != nil {
+			t.Errorf("encoding %s as type %d: %s", test.value, test.metricType, err)
+			continue
+		}
+		var id xdrWriter
+		id.metricID(test.msg, "h", "m", false)
+		if expected := append(id.Bytes(), unhex(t, test.encoded)...); !bytes.Equal(p, expected) {
+			t.Errorf("got packet\n%s\nfor %s as type %d, expected\n%s", hex.Dump(p), test.value, test.metricType, hex.Dump(expected))
+		}
+	}
+
+	for _, test := range []struct {
+		metricType uint32
+		value      string
+	}{
+		{Ushort, "65536"},
+		{Short, "40000"},
+		{Uint, "-1"},
+		{Double, "many"},
+		{99, "1"},
+	} {
+		if _, err := encodeValue("h", false, "m", test.value, test.metricType); err == nil {
+			t.Errorf("encoding %s as type %d succeeded", test.value, test.metricType)
+		}
+	}
+}
+
+func TestGmetricOutOfRange(t *testing.T) {
+	for _, test := range []struct {
+		metricType uint32
+		value      string
+	}{
+		{Uint, "5000000000"},
+		{Short, "-40000"},
+		{Float, "1e39"},
+	} {
+		if _, err := encodeValue("h", false, "m", test.value, test.metricType); !errors.Is(err, strconv.ErrRange) {
+			t.Errorf("got %v encoding %s as type %d, expected a range error", err, test.value, test.metricType)
+		}
+	}
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	gm := &GmetricClient{Host: "h"}
+	gm.AddServer(GmondServer{Addr: conn.LocalAddr().(*net.UDPAddr)})
+	defer gm.Close()
+
+	// sent as a string, rather than dropped
+	if err := gm.SendMetric("m", "5000000000", Uint, "bytes", 60, 0, ""); err != nil {
+		t.Fatalf("SendMetric: %s", err)
+	}
+	meta, err := encodeMetadata("h", false, "m", "bytes", String, slopeBoth, 60, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	val, err := encodeValue("h", false, "m", "5000000000", String)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 1500)
+	for _, expected := range [][]byte{meta, val} {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := conn.ReadFrom(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b[:n], expected) {
+			t.Errorf("got packet\n%s\nexpected\n%s", hex.Dump(b[:n]), hex.Dump(expected))
+		}
+	}
+}
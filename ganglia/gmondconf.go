@@ -0,0 +1,478 @@
+package ganglia
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// GmondConf is the parts of a gmond configuration used to send metrics.
+type GmondConf struct {
+	// Root holds the options and sections at the top level of the file and
+	// the files it includes.
+	Root *ConfSection
+	// UDPSendChannels are the udp_send_channel sections, in order.
+	UDPSendChannels []UDPSendChannel
+}
+
+// UDPSendChannel is a destination for metrics configured by a
+// udp_send_channel section.
+type UDPSendChannel struct {
+	// Host is the unicast host metrics are sent to. Either it or McastJoin
+	// is set.
+	Host string
+	// McastJoin is the multicast group metrics are sent to, and McastIf the
+	// interface to send them from, if given.
+	McastJoin, McastIf string
+	Port               int
+	// TTL is the time to live of multicast packets.
+	TTL int
+	// BindHostname, if true, sends packets from the address the local
+	// hostname resolves to.
+	BindHostname bool
+	// File and Line give the location of the section.
+	File string
+	Line int
+}
+
+// Addr returns the host or multicast group metrics are sent to.
+func (c UDPSendChannel) Addr() string {
+	if c.McastJoin != "" {
+		return c.McastJoin
+	}
+	return c.Host
+}
+
+// ConfSection is a section of a gmond configuration, such as
+//
+//	udp_send_channel {
+//	  host = "gmond.example.com"
+//	  port = 8649
+//	}
+//
+// Options map names to their values. Most options have one value, but lists
+// like ("a", "b") have several. Since gmond matches the names of sections and
+// options regardless of case, they're lowercased.
+type ConfSection struct {
+	Name, Title string
+	File        string
+	Line        int
+	Options     map[string][]string
+	Sections    []*ConfSection
+
+	optionLines map[string]int
+}
+
+func newConfSection(name, title, file string, line int) *ConfSection {
+	return &ConfSection{
+		Name:        name,
+		Title:       title,
+		File:        file,
+		Line:        line,
+		Options:     make(map[string][]string),
+		optionLines: make(map[string]int),
+	}
+}
+
+// Get returns the first value of the option called name, in any case.
+func (s *ConfSection) Get(name string) (string, bool) {
+	values := s.Options[strings.ToLower(name)]
+	if len(values) == 0 {
+		return "", false
+	}
+	return values[0], true
+}
+
+// ConfError is an error in a gmond configuration file.
+type ConfError struct {
+	File string
+	Line int
+	Msg  string
+}
+
+func (e *ConfError) Error() string {
+	return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Msg)
+}
+
+// default port of gmond's udp channels
+const defaultGmondPort = 8649
+
+// maximum depth of nested includes, to catch include loops
+const maxIncludeDepth = 16
+
+// ParseGmondConf reads the gmond configuration in path, and the files it
+// includes. Unlike gmond, which finds relative include paths from its
+// working directory, ParseGmondConf finds them from the directory of the
+// including file, since the working directory of the process reading the
+// configuration needn't be gmond's.
+func ParseGmondConf(path string) (*GmondConf, error) {
+	root := newConfSection("", "", path, 0)
+	if err := parseConfFile(path, root, 0); err != nil {
+		return nil, err
+	}
+	conf := &GmondConf{Root: root}
+	for _, s := range root.Sections {
+		if s.Name != "udp_send_channel" {
+			continue
+		}
+		c, err := sendChannel(s)
+		if err != nil {
+			return nil, err
+		}
+		conf.UDPSendChannels = append(conf.UDPSendChannels, c)
+	}
+	return conf, nil
+}
+
+func parseConfFile(path string, into *ConfSection, depth int) error {
+	src, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	p := &confParser{lex: confLexer{file: path, src: src, line: 1}, depth: depth}
+	return p.parseBody(into, true)
+}
+
+func sendChannel(s *ConfSection) (UDPSendChannel, error) {
+	c := UDPSendChannel{Port: defaultGmondPort, TTL: 1, File: s.File, Line: s.Line}
+	c.Host, _ = s.Get("host")
+	c.McastJoin, _ = s.Get("mcast_join")
+	c.McastIf, _ = s.Get("mcast_if")
+	var err error
+	if c.Port, err = s.intOption("port", c.Port); err != nil {
+		return c, err
+	}
+	if c.TTL, err = s.intOption("ttl", c.TTL); err != nil {
+		return c, err
+	}
+	if v, ok := s.Get("bind_hostname"); ok {
+		if c.BindHostname, ok = confBool(v); !ok {
+			return c, s.optionError("bind_hostname", "bad boolean %q", v)
+		}
+	}
+	if c.Host == "" && c.McastJoin == "" {
+		return c, &ConfError{s.File, s.Line, "udp_send_channel has neither host nor mcast_join"}
+	}
+	if c.Host != "" && c.McastJoin != "" {
+		return c, &ConfError{s.File, s.Line, "udp_send_channel has both host and mcast_join"}
+	}
+	return c, nil
+}
+
+func (s *ConfSection) intOption(name string, def int) (int, error) {
+	v, ok := s.Get(name)
+	if !ok {
+		return def, nil
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, s.optionError(name, "bad %s %q", name, v)
+	}
+	return i, nil
+}
+
+func (s *ConfSection) optionError(name, format string, args ...interface{}) error {
+	return &ConfError{s.File, s.optionLines[name], fmt.Sprintf(format, args...)}
+}
+
+func confBool(v string) (b, ok bool) {
+	switch strings.ToLower(v) {
+	case "yes", "true", "on":
+		return true, true
+	case "no", "false", "off":
+		return false, true
+	}
+	return false, false
+}
+
+// token kinds other than punctuation, which is its own kind
+const (
+	tokEOF    = 0
+	tokWord   = 'w'
+	tokString = 's'
+)
+
+type confToken struct {
+	kind byte
+	text string
+	line int
+}
+
+func (t confToken) String() string {
+	switch t.kind {
+	case tokEOF:
+		return "end of file"
+	case tokWord:
+		return strconv.Quote(t.text)
+	case tokString:
+		return "string " + strconv.Quote(t.text)
+	}
+	return strconv.QuoteRune(rune(t.kind))
+}
+
+// confLexer splits a gmond configuration into tokens.
+type confLexer struct {
+	file string
+	src  []byte
+	pos  int
+	line int
+}
+
+func (l *confLexer) errorf(line int, format string, args ...interface{}) error {
+	return &ConfError{l.file, line, fmt.Sprintf(format, args...)}
+}
+
+func (l *confLexer) next() (confToken, error) {
+	if err := l.skipSpace(); err != nil {
+		return confToken{}, err
+	}
+	if l.pos >= len(l.src) {
+		return confToken{kind: tokEOF, line: l.line}, nil
+	}
+	c := l.src[l.pos]
+	switch c {
+	case '{', '}', '=', '(', ')', ',', ';':
+		l.pos++
+		return confToken{kind: c, line: l.line}, nil
+	case '"', '\'':
+		return l.quoted(c)
+	}
+	start := l.pos
+	for l.pos < len(l.src) && !isConfDelim(l.src[l.pos]) {
+		l.pos++
+	}
+	return confToken{kind: tokWord, text: string(l.src[start:l.pos]), line: l.line}, nil
+}
+
+func isConfDelim(c byte) bool {
+	switch c {
+	case ' ', '\t', '\r', '\n', '{', '}', '=', '(', ')', ',', ';', '"', '\'', '#':
+		return true
+	}
+	return false
+}
+
+// skipSpace skips whitespace and comments.
+func (l *confLexer) skipSpace() error {
+	for l.pos < len(l.src) {
+		switch c := l.src[l.pos]; {
+		case c == '\n':
+			l.line++
+			l.pos++
+		case c == ' ' || c == '\t' || c == '\r':
+			l.pos++
+		case c == '#' || l.hasPrefix("//"):
+			for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+				l.pos++
+			}
+		case l.hasPrefix("/*"):
+			start := l.line
+			end := strings.Index(string(l.src[l.pos+2:]), "*/")
+			if end < 0 {
+				return l.errorf(start, "unterminated comment")
+			}
+			comment := l.src[l.pos : l.pos+2+end+2]
+			l.line += strings.Count(string(comment), "\n")
+			l.pos += len(comment)
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+func (l *confLexer) hasPrefix(s string) bool {
+	return strings.HasPrefix(string(l.src[l.pos:]), s)
+}
+
+func (l *confLexer) quoted(quote byte) (confToken, error) {
+	start := l.line
+	l.pos++
+	var b []byte
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		l.pos++
+		switch c {
+		case quote:
+			return confToken{kind: tokString, text: string(b), line: start}, nil
+		case '\n':
+			l.line++
+		case '\\':
+			if l.pos < len(l.src) {
+				c = l.src[l.pos]
+				l.pos++
+				switch c {
+				case 'n':
+					c = '\n'
+				case 't':
+					c = '\t'
+				case '\n':
+					l.line++
+				}
+			}
+		}
+		b = append(b, c)
+	}
+	return confToken{}, l.errorf(start, "unterminated string")
+}
+
+// confParser parses the grammar of gmond's configuration files: options of
+// the form name = value or name = (value, ...), sections of the form
+// name ["title"] { ... }, and include ("glob") directives.
+type confParser struct {
+	lex    confLexer
+	peeked *confToken
+	depth  int
+}
+
+func (p *confParser) next() (confToken, error) {
+	if t := p.peeked; t != nil {
+		p.peeked = nil
+		return *t, nil
+	}
+	return p.lex.next()
+}
+
+func (p *confParser) peek() (confToken, error) {
+	if p.peeked == nil {
+		t, err := p.lex.next()
+		if err != nil {
+			return t, err
+		}
+		p.peeked = &t
+	}
+	return *p.peeked, nil
+}
+
+// parseBody parses options and sections into sec until the closing brace,
+// or the end of the file if top is true.
+func (p *confParser) parseBody(sec *ConfSection, top bool) error {
+	for {
+		t, err := p.next()
+		if err != nil {
+			return err
+		}
+		switch t.kind {
+		case tokEOF:
+			if !top {
+				return p.lex.errorf(t.line, "missing } to close %s section from line %d", sec.Name, sec.Line)
+			}
+			return nil
+		case '}':
+			if top {
+				return p.lex.errorf(t.line, "unexpected }")
+			}
+			return nil
+		case ',', ';':
+			continue
+		case tokWord:
+			if err := p.parseStatement(sec, t); err != nil {
+				return err
+			}
+		default:
+			return p.lex.errorf(t.line, "unexpected %s", t)
+		}
+	}
+}
+
+func (p *confParser) parseStatement(sec *ConfSection, name confToken) error {
+	t, err := p.next()
+	if err != nil {
+		return err
+	}
+	if strings.EqualFold(name.text, "include") && (t.kind == '(' || t.kind == tokString) {
+		values, err := p.parseValues(t)
+		if err != nil {
+			return err
+		}
+		return p.include(sec, values, name.line)
+	}
+
+	switch t.kind {
+	case '=':
+		v, err := p.next()
+		if err != nil {
+			return err
+		}
+		values, err := p.parseValues(v)
+		if err != nil {
+			return err
+		}
+		key := strings.ToLower(name.text)
+		sec.Options[key] = values
+		sec.optionLines[key] = name.line
+		return nil
+	case tokString, tokWord:
+		brace, err := p.next()
+		if err != nil {
+			return err
+		}
+		if brace.kind != '{' {
+			return p.lex.errorf(brace.line, "expected { after %s %s, found %s", name.text, t, brace)
+		}
+		child := newConfSection(strings.ToLower(name.text), t.text, p.lex.file, name.line)
+		sec.Sections = append(sec.Sections, child)
+		return p.parseBody(child, false)
+	case '{':
+		child := newConfSection(strings.ToLower(name.text), "", p.lex.file, name.line)
+		sec.Sections = append(sec.Sections, child)
+		return p.parseBody(child, false)
+	}
+	return p.lex.errorf(t.line, "expected = or { after %s, found %s", name.text, t)
+}
+
+// parseValues parses the value starting with t: a word, a string, or a
+// parenthesized list of them.
+func (p *confParser) parseValues(t confToken) ([]string, error) {
+	switch t.kind {
+	case tokString, tokWord:
+		return []string{t.text}, nil
+	case '(':
+	default:
+		return nil, p.lex.errorf(t.line, "expected a value, found %s", t)
+	}
+	var values []string
+	for {
+		t, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		switch t.kind {
+		case ')':
+			return values, nil
+		case ',':
+		case tokString, tokWord:
+			values = append(values, t.text)
+		default:
+			return nil, p.lex.errorf(t.line, "expected a value or ), found %s", t)
+		}
+	}
+}
+
+// include parses the files matching patterns into sec. Relative patterns
+// are relative to the directory of the including file, rather than the
+// working directory as in libconfuse; see ParseGmondConf.
+func (p *confParser) include(sec *ConfSection, patterns []string, line int) error {
+	if p.depth >= maxIncludeDepth {
+		return p.lex.errorf(line, "includes nested more than %d deep", maxIncludeDepth)
+	}
+	for _, pattern := range patterns {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(p.lex.file), pattern)
+		}
+		files, err := filepath.Glob(pattern)
+		if err != nil {
+			return p.lex.errorf(line, "bad include pattern %q: %s", pattern, err)
+		}
+		sort.Strings(files)
+		for _, file := range files {
+			if err := parseConfFile(file, sec, p.depth+1); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
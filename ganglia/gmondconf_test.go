@@ -0,0 +1,124 @@
+package ganglia
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeConf(t *testing.T, dir string, files map[string]string) {
+	for name, src := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestParseGmondConf(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gmondconf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeConf(t, dir, map[string]string{
+		"gmond.conf": `/* This configuration is as close to 2.5.x default behavior as possible
+   The values closely match ./gmond/metric.h definitions in 2.5.x */
+globals {
+  daemonize = yes
+  user = nobody # not root
+}
+
+cluster {
+  name = "web \"east\""
+}
+
+// udp_send_channel { host = commented.example.com }
+udp_send_channel {
+  mcast_join = 239.2.11.71
+  port = 8649
+  ttl = 3
+  bind_hostname = yes
+}
+
+INCLUDE ('conf.d/*.conf')
+
+collection_group {
+  collect_every = 20
+  metric { name = "load_one" value_threshold = "1.0" }
+}
+`,
+		"conf.d/a.conf": `udp_send_channel {
+  host = 'gmond.example.com'
+}
+`,
+		"conf.d/b.conf": `modules { module "python" { path = "modpython.so" params = ("a", "b") } }`,
+		"conf.d/c.txt":  `garbage`,
+		"conf.d/d.conf": `UDP_SEND_CHANNEL { Host = upper.example.com PORT = 8650 }`,
+	})
+
+	conf, err := ParseGmondConf(filepath.Join(dir, "gmond.conf"))
+	if err != nil {
+		t.Fatalf("ParseGmondConf: %s", err)
+	}
+	expected := []UDPSendChannel{
+		{McastJoin: "239.2.11.71", Port: 8649, TTL: 3, BindHostname: true, File: filepath.Join(dir, "gmond.conf"), Line: 13},
+		{Host: "gmond.example.com", Port: defaultGmondPort, TTL: 1, File: filepath.Join(dir, "conf.d/a.conf"), Line: 1},
+		{Host: "upper.example.com", Port: 8650, TTL: 1, File: filepath.Join(dir, "conf.d/d.conf"), Line: 1},
+	}
+	if !reflect.DeepEqual(conf.UDPSendChannels, expected) {
+		t.Errorf("got channels %+v, expected %+v", conf.UDPSendChannels, expected)
+	}
+
+	var names []string
+	for _, s := range conf.Root.Sections {
+		names = append(names, s.Name)
+	}
+	if got := strings.Join(names, " "); got != "globals cluster udp_send_channel udp_send_channel modules udp_send_channel collection_group" {
+		t.Errorf("got sections %q", got)
+	}
+	if name, _ := conf.Root.Sections[1].Get("name"); name != `web "east"` {
+		t.Errorf("got cluster name %q", name)
+	}
+	module := conf.Root.Sections[4].Sections[0]
+	if module.Title != "python" || !reflect.DeepEqual(module.Options["params"], []string{"a", "b"}) {
+		t.Errorf("got module %+v", module)
+	}
+	metric := conf.Root.Sections[6].Sections[0]
+	if v, _ := metric.Get("value_threshold"); v != "1.0" || metric.Line != 24 {
+		t.Errorf("got metric %+v", metric)
+	}
+}
+
+func TestParseGmondConfErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gmondconf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for src, expected := range map[string]string{
+		"globals {\n  daemonize = yes\n":         ":3: missing } to close globals section from line 1",
+		"a = 1\n}\n":                             ":2: unexpected }",
+		"a = 1\n\nb = \"unterminated\n":          ":3: unterminated string",
+		"/* a\n\n":                               ":1: unterminated comment",
+		"a\n= =\n":                               ":2: expected a value, found '='",
+		"udp_send_channel {\n  port = 8649\n}\n": ":1: udp_send_channel has neither host nor mcast_join",
+		"udp_send_channel {\n  host = a\n  port = eighty\n}\n":    ":3: bad port \"eighty\"",
+		"udp_send_channel {\n host = a\n bind_hostname = maybe }": ":3: bad boolean \"maybe\"",
+		"include ('loop.conf')\n":                                 "includes nested more than 16 deep",
+	} {
+		path := filepath.Join(dir, "loop.conf")
+		writeConf(t, dir, map[string]string{"loop.conf": src})
+		_, err := ParseGmondConf(path)
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("got error %v for %q, expected %q", err, src, expected)
+		}
+	}
+}
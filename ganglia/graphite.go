@@ -0,0 +1,88 @@
+package ganglia
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// GraphiteSink publishes metrics to a Graphite server using its plaintext
+// protocol. Metric paths are the group name set with Configure, if any,
+// followed by the prefixed metric name. Rates are computed before sending,
+// and string metrics are skipped.
+type GraphiteSink struct {
+	addr string
+	// Timeout limits how long connecting and sending a batch may take.
+	Timeout time.Duration
+
+	conn  net.Conn
+	rates rateTracker
+}
+
+// NewGraphiteSink returns a Sink which sends metrics to the carbon server at
+// addr, a TCP host:port. The connection is kept open between batches.
+func NewGraphiteSink(addr string) *GraphiteSink {
+	return &GraphiteSink{addr: addr, Timeout: 5 * time.Second}
+}
+
+func (s *GraphiteSink) Publish(b *Batch) error {
+	if s.conn == nil {
+		conn, err := net.DialTimeout("tcp", s.addr, s.Timeout)
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(s.Timeout))
+
+	w := bufio.NewWriter(s.conn)
+	for _, m := range b.Metrics {
+		if m.Type == String {
+			continue
+		}
+		if m.Rate {
+			r, ok := s.rates.rate(m, b.Time)
+			if !ok {
+				continue
+			}
+			m = r
+		}
+		fmt.Fprintf(w, "%s %s %d\n", graphitePath(b.Group, b.Prefix+m.Name), m.Value, b.Time.Unix())
+	}
+	if err := w.Flush(); err != nil {
+		s.Close()
+		return err
+	}
+	return nil
+}
+
+// Close closes the connection to the server. It's reopened by the next call
+// to Publish.
+func (s *GraphiteSink) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+// graphitePath joins group and name into a metric path, replacing characters
+// that carbon doesn't accept.
+func graphitePath(group, name string) string {
+	sanitize := func(s string) string {
+		return strings.Map(func(r rune) rune {
+			switch {
+			case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '-', r == '.':
+				return r
+			}
+			return '_'
+		}, s)
+	}
+	if group == "" {
+		return sanitize(name)
+	}
+	return sanitize(group) + "." + sanitize(name)
+}
@@ -0,0 +1,185 @@
+package ganglia
+
+import (
+	"math"
+	"math/bits"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Histograms bucket values logarithmically, with 2^histSubBucketBits linear
+// sub-buckets per power of two, so any value is recorded to within 1/128 of
+// itself, as in an HDR histogram. histBuckets covers all non-negative int64s.
+const (
+	histSubBucketBits = 7
+	histSubBuckets    = 1 << histSubBucketBits
+	histBuckets       = histSubBuckets * (64 - histSubBucketBits)
+)
+
+// histIndex returns the bucket v is counted in.
+func histIndex(v uint64) int {
+	shift := bits.Len64(v) - (histSubBucketBits + 1)
+	if shift < 0 {
+		shift = 0
+	}
+	return histSubBuckets*shift + int(v>>uint(shift))
+}
+
+// histValue returns the highest value counted in bucket i.
+func histValue(i int) uint64 {
+	if i < 2*histSubBuckets {
+		return uint64(i)
+	}
+	shift := uint(i/histSubBuckets - 1)
+	top := uint64(i - histSubBuckets*int(shift))
+	return (top+1)<<shift - 1
+}
+
+// DefaultPercentiles are the percentiles reported by histograms for which
+// none are given.
+var DefaultPercentiles = []float64{50, 90, 99, 99.9}
+
+// A Histogram records the distribution of non-negative values, such as
+// latencies, and reports percentiles of those recorded during each round.
+// Its counts are cumulative, so that each reader of its Registry is reported
+// the values recorded since that reader's previous round. It's safe for
+// concurrent use.
+type Histogram struct {
+	units       string
+	percentiles []float64
+	counts      histCounts // values recorded ever, accessed atomically
+}
+
+type histCounts struct {
+	counts [histBuckets]uint64
+	n, sum uint64
+	max    uint64
+}
+
+func newHistogram(units string, percentiles []float64) *Histogram {
+	if len(percentiles) == 0 {
+		percentiles = DefaultPercentiles
+	}
+	p := append([]float64(nil), percentiles...)
+	sort.Float64s(p)
+	return &Histogram{units: units, percentiles: p}
+}
+
+// Record adds v to the histogram. Negative values are recorded as 0.
+func (h *Histogram) Record(v int64) {
+	if v < 0 {
+		v = 0
+	}
+	u := uint64(v)
+	c := &h.counts
+	atomic.AddUint64(&c.counts[histIndex(u)], 1)
+	atomic.AddUint64(&c.sum, u)
+	for {
+		max := atomic.LoadUint64(&c.max)
+		if u <= max || atomic.CompareAndSwapUint64(&c.max, max, u) {
+			break
+		}
+	}
+	atomic.AddUint64(&c.n, 1)
+}
+
+// durationUnits are the units RecordDuration converts durations into.
+var durationUnits = map[string]time.Duration{
+	"ns":   time.Nanosecond,
+	"us":   time.Microsecond,
+	"µs":   time.Microsecond,
+	"ms":   time.Millisecond,
+	"s":    time.Second,
+	"sec":  time.Second,
+	"secs": time.Second,
+}
+
+// RecordDuration records d in the histogram's units, which must be one of
+// "ns", "us", "ms" or "s", or otherwise d is recorded in nanoseconds.
+func (h *Histogram) RecordDuration(d time.Duration) {
+	if unit, ok := durationUnits[h.units]; ok {
+		d /= unit
+	}
+	h.Record(int64(d))
+}
+
+// Since records the time elapsed since start, as RecordDuration.
+func (h *Histogram) Since(start time.Time) {
+	h.RecordDuration(time.Since(start))
+}
+
+// Count returns the number of values ever recorded.
+func (h *Histogram) Count() uint64 {
+	return atomic.LoadUint64(&h.counts.n)
+}
+
+// HistogramSnapshot summarizes the values recorded by a Histogram during an
+// interval.
+type HistogramSnapshot struct {
+	Count       uint64
+	Mean        float64
+	Max         uint64
+	Percentiles map[float64]uint64
+}
+
+// load returns a copy of the counts of the values recorded so far.
+func (h *Histogram) load() *histCounts {
+	c := new(histCounts)
+	for i := range c.counts {
+		c.counts[i] = atomic.LoadUint64(&h.counts.counts[i])
+	}
+	c.n = atomic.LoadUint64(&h.counts.n)
+	c.sum = atomic.LoadUint64(&h.counts.sum)
+	c.max = atomic.LoadUint64(&h.counts.max)
+	return c
+}
+
+// snapshot summarizes the values counted in cur, a copy returned by load,
+// which weren't yet counted in prev, an earlier copy, or all of them if
+// prev is nil. Unless it's the greatest value ever recorded, the maximum is
+// only known to within the precision of the buckets.
+func (h *Histogram) snapshot(cur, prev *histCounts) HistogramSnapshot {
+	if prev == nil {
+		prev = new(histCounts)
+	}
+	// counted from the buckets, since cur's fields weren't loaded at once
+	var top int
+	var n uint64
+	for i := range cur.counts {
+		if d := cur.counts[i] - prev.counts[i]; d > 0 {
+			n += d
+			top = i
+		}
+	}
+
+	s := HistogramSnapshot{Count: n, Percentiles: make(map[float64]uint64, len(h.percentiles))}
+	if n == 0 {
+		return s
+	}
+	if s.Max = histValue(top); s.Max > cur.max {
+		s.Max = cur.max
+	}
+	s.Mean = float64(cur.sum-prev.sum) / float64(n)
+	var seen uint64
+	i := 0
+	for _, p := range h.percentiles {
+		rank := uint64(math.Ceil(p / 100 * float64(n)))
+		if rank < 1 {
+			rank = 1
+		}
+		for ; i < top; i++ {
+			d := cur.counts[i] - prev.counts[i]
+			if seen+d >= rank {
+				break
+			}
+			seen += d
+		}
+		v := histValue(i)
+		if v > s.Max {
+			v = s.Max
+		}
+		s.Percentiles[p] = v
+	}
+	return s
+}
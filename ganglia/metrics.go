@@ -0,0 +1,208 @@
+package ganglia
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// A Counter is a running total, reported as a rate. It's safe for
+// concurrent use.
+type Counter struct {
+	v uint64
+}
+
+// Inc adds 1 to c.
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.v, 1)
+}
+
+// Add adds n to c.
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.v, n)
+}
+
+// Value returns the total.
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.v)
+}
+
+// A Gauge is a value which may go up or down, reported as it is. It's safe
+// for concurrent use.
+type Gauge struct {
+	bits uint64
+}
+
+// Set sets g to v.
+func (g *Gauge) Set(v float64) {
+	atomic.StoreUint64(&g.bits, math.Float64bits(v))
+}
+
+// Add adds delta, which may be negative, to g.
+func (g *Gauge) Add(delta float64) {
+	for {
+		old := atomic.LoadUint64(&g.bits)
+		v := math.Float64frombits(old) + delta
+		if atomic.CompareAndSwapUint64(&g.bits, old, math.Float64bits(v)) {
+			return
+		}
+	}
+}
+
+// Value returns g's current value.
+func (g *Gauge) Value() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&g.bits))
+}
+
+// A Registry holds named metrics, and reports them to a Reporter it's added
+// to with AddRegistry. Metrics are created by the first request for their
+// name; later requests return the same metric.
+type Registry struct {
+	mu      sync.Mutex
+	names   map[string]int // index into metrics
+	metrics []registered
+	// the histogram counts last reported to each reader, or to Report
+	// under nil
+	reported map[*reader]map[*Histogram]*histCounts
+}
+
+type registered struct {
+	name, units string
+	metric      interface{} // *Counter, *Gauge or *Histogram
+}
+
+// NewRegistry returns an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{names: make(map[string]int), reported: make(map[*reader]map[*Histogram]*histCounts)}
+}
+
+// DefaultRegistry is reported by the global Reporter returned by Gmetric.
+var DefaultRegistry = NewRegistry()
+
+// get returns the metric called name, creating it with create if there is
+// none.
+func (r *Registry) get(name, units string, create func() interface{}) interface{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if i, ok := r.names[name]; ok {
+		return r.metrics[i].metric
+	}
+	m := create()
+	r.names[name] = len(r.metrics)
+	r.metrics = append(r.metrics, registered{name, units, m})
+	return m
+}
+
+func registeredAs(name string, m interface{}) string {
+	return fmt.Sprintf("ganglia: metric %q is already registered as a %T", name, m)
+}
+
+// Counter returns the counter called name. It panics if name is registered
+// as another kind of metric, as do Gauge and Histogram.
+func (r *Registry) Counter(name, units string) *Counter {
+	m := r.get(name, units, func() interface{} { return new(Counter) })
+	c, ok := m.(*Counter)
+	if !ok {
+		panic(registeredAs(name, m))
+	}
+	return c
+}
+
+// Gauge returns the gauge called name.
+func (r *Registry) Gauge(name, units string) *Gauge {
+	m := r.get(name, units, func() interface{} { return new(Gauge) })
+	g, ok := m.(*Gauge)
+	if !ok {
+		panic(registeredAs(name, m))
+	}
+	return g
+}
+
+// Histogram returns the histogram called name. It reports the given
+// percentiles, or DefaultPercentiles if there are none, and the maximum and
+// mean of the values recorded since the previous round, as name_p50, name_max,
+// name_mean and so on. The number of values recorded is reported as the rate
+// name_count. percentiles are ignored if the histogram already exists.
+func (r *Registry) Histogram(name, units string, percentiles ...float64) *Histogram {
+	m := r.get(name, units, func() interface{} { return newHistogram(units, percentiles) })
+	h, ok := m.(*Histogram)
+	if !ok {
+		panic(registeredAs(name, m))
+	}
+	return h
+}
+
+// Report sends the values of r's metrics to gmetric. It's a
+// ReporterCallback. Histograms report the values recorded since the previous
+// call to Report, so a Reporter with more than one reader, such as its sinks
+// and a PrometheusHandler, should be given r with AddRegistry instead.
+func (r *Registry) Report(gmetric MetricSender) {
+	r.report(gmetric, nil)
+}
+
+// report is Report for rd, whose histograms report the values recorded
+// since rd's previous round.
+func (r *Registry) report(gmetric MetricSender, rd *reader) {
+	r.mu.Lock()
+	metrics := append([]registered(nil), r.metrics...)
+	reported := r.reported[rd]
+	if reported == nil {
+		reported = make(map[*Histogram]*histCounts)
+		r.reported[rd] = reported
+	}
+	r.mu.Unlock()
+
+	for _, m := range metrics {
+		switch metric := m.metric.(type) {
+		case *Counter:
+			gmetric(m.name, strconv.FormatUint(metric.Value(), 10), Uint, m.units, true)
+		case *Gauge:
+			gmetric(m.name, formatFloat(metric.Value()), Double, m.units, false)
+		case *Histogram:
+			// loaded under the lock, so that concurrent reports to one
+			// reader can't count values twice
+			r.mu.Lock()
+			cur := metric.load()
+			prev := reported[metric]
+			reported[metric] = cur
+			r.mu.Unlock()
+			s := metric.snapshot(cur, prev)
+			gmetric(m.name+"_count", strconv.FormatUint(metric.Count(), 10), Uint, "samples", true)
+			if s.Count == 0 {
+				continue
+			}
+			gmetric(m.name+"_max", strconv.FormatUint(s.Max, 10), Double, m.units, false)
+			gmetric(m.name+"_mean", formatFloat(s.Mean), Double, m.units, false)
+			for _, p := range metric.percentiles {
+				gmetric(m.name+"_"+percentileName(p), strconv.FormatUint(s.Percentiles[p], 10), Double, m.units, false)
+			}
+		}
+	}
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// percentileName returns the suffix for percentile p, e.g. "p99_9".
+func percentileName(p float64) string {
+	return "p" + strings.Replace(formatFloat(p), ".", "_", -1)
+}
+
+// NewCounter returns the counter called name in DefaultRegistry.
+func NewCounter(name, units string) *Counter {
+	return DefaultRegistry.Counter(name, units)
+}
+
+// NewGauge returns the gauge called name in DefaultRegistry.
+func NewGauge(name, units string) *Gauge {
+	return DefaultRegistry.Gauge(name, units)
+}
+
+// NewHistogram returns the histogram called name in DefaultRegistry.
+func NewHistogram(name, units string, percentiles ...float64) *Histogram {
+	return DefaultRegistry.Histogram(name, units, percentiles...)
+}
@@ -0,0 +1,170 @@
+package ganglia
+
+import (
+	"math/rand"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHistIndex(t *testing.T) {
+	prev := -1
+	for _, v := range []uint64{0, 1, 127, 255, 256, 257, 1000, 1 << 20, 1<<63 - 1} {
+		i := histIndex(v)
+		if i < prev {
+			t.Errorf("bucket %d for %d is below the previous bucket %d", i, v, prev)
+		}
+		if i >= histBuckets {
+			t.Fatalf("bucket %d for %d is out of range", i, v)
+		}
+		hi := histValue(i)
+		if hi < v || float64(hi-v) > float64(v)/histSubBuckets {
+			t.Errorf("bucket %d for %d has highest value %d, which isn't within 1/%d", i, v, hi, histSubBuckets)
+		}
+		prev = i
+	}
+}
+
+func TestHistogramPercentiles(t *testing.T) {
+	h := newHistogram("ms", []float64{99, 50})
+	for _, v := range rand.Perm(1000) {
+		h.Record(int64(v + 1))
+	}
+	first := h.load()
+	s := h.snapshot(first, nil)
+	if s.Count != 1000 || s.Max != 1000 || s.Mean != 500.5 {
+		t.Errorf("got snapshot %+v, expected 1000 values up to 1000 with mean 500.5", s)
+	}
+	for p, expected := range map[float64]uint64{50: 500, 99: 990} {
+		if got := s.Percentiles[p]; got < expected || float64(got-expected) > float64(expected)/histSubBuckets {
+			t.Errorf("got p%v %d, expected about %d", p, got, expected)
+		}
+	}
+
+	// a snapshot against an earlier copy covers the values recorded since
+	h.RecordDuration(3 * time.Millisecond)
+	if s := h.snapshot(h.load(), first); s.Count != 1 || s.Max != 3 || s.Percentiles[50] != 3 {
+		t.Errorf("got snapshot %+v for the second interval, expected one value of 3", s)
+	}
+	if n := h.Count(); n != 1001 {
+		t.Errorf("got total count %d, expected 1001", n)
+	}
+}
+
+func TestRegistryReport(t *testing.T) {
+	r := NewRegistry()
+	reqs := r.Counter("requests", "reqs")
+	inflight := r.Gauge("inflight", "reqs")
+	latency := r.Histogram("latency", "ms", 50)
+	if r.Counter("requests", "reqs") != reqs {
+		t.Errorf("second request for a counter returned a new one")
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				reqs.Inc()
+				inflight.Add(1)
+				latency.Record(7)
+				inflight.Add(-1)
+			}
+		}()
+	}
+	wg.Wait()
+	inflight.Set(2.5)
+
+	var sink MemorySink
+	gr := NewReporter(time.Hour, &sink)
+	defer gr.Stop()
+	gr.AddRegistry(r)
+	sink.Publish(gr.collect(&gr.rounds))
+
+	for name, expected := range map[string]Metric{
+		"requests":      {"requests", "1000", Uint, "reqs", true},
+		"inflight":      {"inflight", "2.5", Double, "reqs", false},
+		"latency_count": {"latency_count", "1000", Uint, "samples", true},
+		"latency_max":   {"latency_max", "7", Double, "ms", false},
+		"latency_mean":  {"latency_mean", "7", Double, "ms", false},
+		"latency_p50":   {"latency_p50", "7", Double, "ms", false},
+	} {
+		if m, ok := sink.Latest(name); !ok || m != expected {
+			t.Errorf("got %+v for %s, expected %+v", m, name, expected)
+		}
+	}
+
+	// an interval without samples reports only the count
+	sink.Publish(gr.collect(&gr.rounds))
+	if n := len(sink.Batches()[1].Metrics); n != 3 {
+		t.Errorf("got %d metrics for an idle interval, expected 3", n)
+	}
+}
+
+func TestRegistryReaders(t *testing.T) {
+	r := NewRegistry()
+	latency := r.Histogram("latency", "ms", 50)
+	gr := NewReporter(time.Hour)
+	defer gr.Stop()
+	gr.AddRegistry(r)
+	h := gr.PrometheusHandler()
+	scrape := func() string {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+		return w.Body.String()
+	}
+	tick := func() map[string]string {
+		values := make(map[string]string)
+		for _, m := range gr.collect(&gr.rounds).Metrics {
+			values[m.Name] = m.Value
+		}
+		return values
+	}
+
+	latency.Record(10)
+	latency.Record(20)
+	// a scrape doesn't take the samples the next tick reports
+	if body := scrape(); !strings.Contains(body, "latency_max_seconds 0.02\n") {
+		t.Errorf("first scrape didn't include both samples:\n%s", body)
+	}
+	if values := tick(); values["latency_max"] != "20" || values["latency_mean"] != "15" {
+		t.Errorf("got %v from the tick after a scrape, expected both samples", values)
+	}
+
+	// nor does a tick take them from the next scrape
+	latency.Record(40)
+	if values := tick(); values["latency_max"] != "40" || values["latency_mean"] != "40" {
+		t.Errorf("got %v from the second tick, expected only the new sample", values)
+	}
+	if body := scrape(); !strings.Contains(body, "latency_max_seconds 0.04\n") || !strings.Contains(body, "latency_p50_seconds 0.04\n") {
+		t.Errorf("second scrape didn't include the sample taken by the tick:\n%s", body)
+	}
+
+	// a reader's idle round reports only the count
+	if values := tick(); values["latency_count"] != "3" || len(values) != 1 {
+		t.Errorf("got %v from an idle tick, expected only latency_count", values)
+	}
+
+	// r.Report keeps a cursor of its own
+	var reported []Metric
+	r.Report(func(name, value string, metricType uint32, units string, rate bool) {
+		reported = append(reported, Metric{name, value, metricType, units, rate})
+	})
+	if len(reported) != 4 {
+		t.Errorf("got %v from Report, expected all three samples", reported)
+	}
+}
+
+func TestRegistryTypeMismatch(t *testing.T) {
+	r := NewRegistry()
+	r.Counter("x", "")
+	defer func() {
+		if recover() == nil {
+			t.Errorf("registering a gauge with a counter's name didn't panic")
+		}
+	}()
+	r.Gauge("x", "")
+}
@@ -0,0 +1,184 @@
+package ganglia
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/fastly/go-utils/vlog"
+)
+
+// PrometheusHandler returns an http.Handler which runs gr's callbacks each
+// time it's requested, and serves the metrics they send in the Prometheus
+// text exposition format.
+//
+// Metric names are the prefixed names with characters Prometheus doesn't
+// allow replaced by underscores, and a suffix for their units. Values in
+// milliseconds, microseconds or nanoseconds are converted to seconds. Rate
+// metrics are served as counters with their running totals, leaving rates to
+// be computed by queries, and others as gauges. String metrics are served as
+// info metrics, with the string as a label. The group name, if set, is added
+// to each metric as the "group" label.
+//
+// Each handler is a reader of its own, so histograms added with AddRegistry
+// serve the values recorded since the handler's previous request, whatever
+// gr's sinks and other handlers have been sent.
+func (gr *Reporter) PrometheusHandler() http.Handler {
+	rd := new(reader)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b := &Batch{}
+		if gr != nil {
+			b = gr.collect(rd)
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writePrometheus(w, b)
+	})
+}
+
+// PrometheusHandler serves the metrics of the global Reporter returned by
+// Gmetric, including those sent to callbacks added with AddGmetrics. See
+// Reporter.PrometheusHandler.
+func PrometheusHandler() http.Handler {
+	return Gmetric().PrometheusHandler()
+}
+
+// promUnits maps the units metrics are sent with to the suffix of their
+// Prometheus names, and the factor that converts values into those units.
+var promUnits = map[string]struct {
+	suffix string
+	scale  float64
+}{
+	"":        {"", 1},
+	"num":     {"", 1},
+	"count":   {"", 1},
+	"b":       {"bytes", 1},
+	"byte":    {"bytes", 1},
+	"bytes":   {"bytes", 1},
+	"s":       {"seconds", 1},
+	"sec":     {"seconds", 1},
+	"secs":    {"seconds", 1},
+	"seconds": {"seconds", 1},
+	"ms":      {"seconds", 1e-3},
+	"us":      {"seconds", 1e-6},
+	"µs":      {"seconds", 1e-6},
+	"ns":      {"seconds", 1e-9},
+	"cpusecs": {"cpu_seconds", 1},
+	"%":       {"percent", 1},
+}
+
+type promMetric struct {
+	name, help, kind string
+	labels           []string // name="value" pairs
+	value            string
+}
+
+// toPrometheus converts m, sent to a reporter with prefix, into the form it's
+// served in.
+func toPrometheus(prefix string, m Metric) (p promMetric, ok bool) {
+	base := promName(prefix + m.Name)
+	p.help = prefix + m.Name
+	if m.Units != "" {
+		p.help += " (" + m.Units + ")"
+	}
+
+	if m.Type == String {
+		p.name, p.kind, p.value = base+"_info", "gauge", "1"
+		p.labels = []string{"value=" + promQuote(m.Value)}
+		return p, true
+	}
+
+	unit, known := promUnits[m.Units]
+	if !known {
+		unit.suffix, unit.scale = promName(strings.ToLower(m.Units)), 1
+	}
+	v, err := strconv.ParseFloat(m.Value, 64)
+	if err != nil {
+		vlog.VLogfQuiet(m.Name, "Value %q of %s isn't numeric: %s", m.Value, m.Name, err)
+		return p, false
+	}
+	p.value = m.Value
+	if unit.scale != 1 {
+		p.value = strconv.FormatFloat(v*unit.scale, 'g', -1, 64)
+	}
+
+	p.kind = "gauge"
+	if m.Rate {
+		p.kind = "counter"
+		base = strings.TrimSuffix(base, "_total")
+	}
+	if unit.suffix != "" && !strings.HasSuffix(base, "_"+unit.suffix) {
+		base += "_" + unit.suffix
+	}
+	if m.Rate {
+		base += "_total"
+	}
+	p.name = base
+	return p, true
+}
+
+// promName replaces the characters of name which aren't allowed in
+// Prometheus metric names.
+func promName(name string) string {
+	if name != "" && name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+	b := []byte(name)
+	for i, c := range b {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '_', c == ':':
+		default:
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+var (
+	promEscaper     = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	promHelpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func promQuote(s string) string {
+	return `"` + promEscaper.Replace(s) + `"`
+}
+
+// writePrometheus renders the metrics in b in the text exposition format.
+func writePrometheus(w io.Writer, b *Batch) error {
+	metrics := make(map[string]promMetric, len(b.Metrics))
+	for _, m := range b.Metrics {
+		p, ok := toPrometheus(b.Prefix, m)
+		if !ok {
+			continue
+		}
+		if _, dup := metrics[p.name]; dup {
+			vlog.VLogfQuiet(p.name, "Skipping duplicate metric %s", p.name)
+			continue
+		}
+		if b.Group != "" {
+			p.labels = append([]string{"group=" + promQuote(b.Group)}, p.labels...)
+		}
+		metrics[p.name] = p
+	}
+	names := make([]string, 0, len(metrics))
+	for name := range metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	bw := bufio.NewWriter(w)
+	for _, name := range names {
+		p := metrics[name]
+		fmt.Fprintf(bw, "# HELP %s %s\n", name, promHelpEscaper.Replace(p.help))
+		fmt.Fprintf(bw, "# TYPE %s %s\n", name, p.kind)
+		if len(p.labels) > 0 {
+			fmt.Fprintf(bw, "%s{%s} %s\n", name, strings.Join(p.labels, ","), p.value)
+		} else {
+			fmt.Fprintf(bw, "%s %s\n", name, p.value)
+		}
+	}
+	return bw.Flush()
+}
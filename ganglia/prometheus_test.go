@@ -0,0 +1,70 @@
+package ganglia
+
+import (
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrometheusHandler(t *testing.T) {
+	gr := NewReporter(time.Hour).Configure("web", "app.")
+	defer gr.Stop()
+	gr.AddCallback(func(gmetric MetricSender) {
+		gmetric("goroutines", "12", Uint, "num", false)
+		gmetric("heap", "1024", Uint, "bytes", false)
+		gmetric("gc_pause_total", "1500", Float, "ms", true)
+		gmetric("requests", "77", Uint, "reqs", true)
+		gmetric("version", `1.2 "beta"`, String, "", false)
+		gmetric("3xx responses", "5", Uint, "", false)
+		gmetric("bogus", "not a number", Uint, "", false)
+	})
+	gr.AddCallback(CommonGmetrics)
+
+	w := httptest.NewRecorder()
+	gr.PrometheusHandler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("got Content-Type %q", ct)
+	}
+	body := w.Body.String()
+
+	for _, expected := range []string{
+		"# HELP app_goroutines app.goroutines (num)\n# TYPE app_goroutines gauge\napp_goroutines{group=\"web\"} 12\n",
+		"# TYPE app_heap_bytes gauge\napp_heap_bytes{group=\"web\"} 1024\n",
+		"# TYPE app_gc_pause_seconds_total counter\napp_gc_pause_seconds_total{group=\"web\"} 1.5\n",
+		"# TYPE app_requests_reqs_total counter\napp_requests_reqs_total{group=\"web\"} 77\n",
+		"app_version_info{group=\"web\",value=\"1.2 \\\"beta\\\"\"} 1\n",
+		"app_3xx_responses{group=\"web\"} 5\n",
+		"# TYPE app_rusage_utime_cpu_seconds_total counter\n",
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("output doesn't contain %q:\n%s", expected, body)
+		}
+	}
+	if strings.Contains(body, "bogus") {
+		t.Errorf("output contains non-numeric metric:\n%s", body)
+	}
+
+	// every sample line must be a valid metric name, optional labels and a value
+	sampleRe := regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*(\{.*\})? \S+$`)
+	for _, line := range strings.Split(strings.TrimSpace(body), "\n") {
+		if !strings.HasPrefix(line, "#") && !sampleRe.MatchString(line) {
+			t.Errorf("invalid sample line %q", line)
+		}
+	}
+}
+
+func TestPromName(t *testing.T) {
+	for name, expected := range map[string]string{
+		"mem_alloc":  "mem_alloc",
+		"app.conns":  "app_conns",
+		"5xx":        "_5xx",
+		"a-b c/d":    "a_b_c_d",
+		"ns:metric1": "ns:metric1",
+	} {
+		if got := promName(name); got != expected {
+			t.Errorf("promName(%q) = %q, expected %q", name, got, expected)
+		}
+	}
+}
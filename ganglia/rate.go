@@ -0,0 +1,197 @@
+package ganglia
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/fastly/go-utils/vlog"
+)
+
+// counterWidth returns the declared width in bits of counters of an integer
+// type, or 0 for other types.
+func counterWidth(metricType uint32) uint {
+	switch metricType {
+	case Ushort, Short:
+		return 16
+	case Uint, Int:
+		return 32
+	}
+	return 0
+}
+
+// An unsigned counter which decreases is only taken to have wrapped if its
+// previous value was within 1/2^wrapMarginShift of the top of its range, and
+// the growth that implies is no more than that margin, and no faster than
+// wrapRateFactor times the counter's previous rate, if it's known.
+const (
+	wrapMarginShift = 3
+	wrapRateFactor  = 10
+)
+
+// counterDelta returns how much an unsigned counter width bits wide has
+// grown from prev to cur. A decrease is taken as a wrap past the top of the
+// range if it's plausible, as described at wrapMarginShift, with limit being
+// the most the counter could have grown at its previous rate. Otherwise it's
+// taken as a reset to zero, as when a process restarts, so the delta is cur.
+func counterDelta(prev, cur uint64, width uint, limit uint64) uint64 {
+	if cur >= prev {
+		return cur - prev
+	}
+	max := uint64(math.MaxUint64) >> (64 - width)
+	margin := max >> wrapMarginShift
+	if prev >= max-margin {
+		// can't overflow, since cur < prev
+		if d := max - prev + cur + 1; d <= margin && d <= limit {
+			return d
+		}
+	}
+	return cur
+}
+
+// kinds of counterSample
+const (
+	unsignedCounter = iota + 1
+	signedCounter
+	floatCounter
+)
+
+// counterSample is the previous value of a running total.
+type counterSample struct {
+	kind  int
+	u     uint64 // if unsignedCounter, within width bits
+	i     int64  // if signedCounter
+	f     float64
+	width uint
+	when  time.Time
+	// rate is the growth per second up to this sample, if rateKnown
+	rate      float64
+	rateKnown bool
+}
+
+// deltaTracker computes how much running totals have grown between
+// samples, allowing for unsigned counters which wrap around at the width of
+// their type, and for counters which are reset, as when a process restarts.
+// Unsigned counters whose values don't fit their type's width are treated
+// as 64 bits wide from then on. Signed integers and floats are never taken
+// to wrap: any decrease is a reset.
+type deltaTracker struct {
+	mu       sync.Mutex
+	previous map[string]counterSample
+}
+
+// delta returns how much m has grown since its previous sample, and the time
+// elapsed since then. ok is false if this is m's first sample, or m isn't
+// numeric.
+func (d *deltaTracker) delta(m Metric, now time.Time) (delta float64, elapsed time.Duration, ok bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.previous == nil {
+		d.previous = make(map[string]counterSample)
+	}
+	prev, exists := d.previous[m.Name]
+	width := counterWidth(m.Type)
+	if exists && prev.width > width {
+		width = prev.width
+	}
+	cur, ok := parseCounter(m, width)
+	if !ok {
+		return 0, 0, false
+	}
+	cur.when = now
+	if !exists || prev.kind != cur.kind {
+		d.previous[m.Name] = cur
+		return 0, 0, false
+	}
+
+	elapsed = now.Sub(prev.when)
+	switch cur.kind {
+	case unsignedCounter:
+		limit := uint64(math.MaxUint64)
+		if prev.rateKnown && elapsed > 0 {
+			if l := wrapRateFactor * prev.rate * elapsed.Seconds(); l < float64(limit) {
+				limit = uint64(l)
+			}
+		}
+		delta = float64(counterDelta(prev.u, cur.u, cur.width, limit))
+	case signedCounter:
+		if cur.i >= prev.i {
+			// two's complement, so the difference is right even if it
+			// overflows an int64
+			delta = float64(uint64(cur.i) - uint64(prev.i))
+		} else if cur.i > 0 {
+			delta = float64(cur.i) // reset
+		}
+	case floatCounter:
+		if delta = cur.f - prev.f; delta < 0 {
+			delta = math.Max(cur.f, 0) // reset
+		}
+	}
+	if elapsed > 0 {
+		cur.rate, cur.rateKnown = delta/elapsed.Seconds(), true
+	}
+	d.previous[m.Name] = cur
+	return delta, elapsed, true
+}
+
+// parseCounter parses m's value according to its type. Unsigned integers
+// are widened to 64 bits if they don't fit in width.
+func parseCounter(m Metric, width uint) (s counterSample, ok bool) {
+	s.width = width
+	switch m.Type {
+	case Ushort, Uint:
+		u, err := strconv.ParseUint(m.Value, 10, 64)
+		if err != nil {
+			vlog.VLogfQuiet(m.Name, "Value %q doesn't look like an unsigned int: %s", m.Value, err)
+			return s, false
+		}
+		if bits.Len64(u) > int(s.width) {
+			s.width = 64
+		}
+		s.kind, s.u = unsignedCounter, u
+	case Short, Int:
+		i, err := strconv.ParseInt(m.Value, 10, 64)
+		if err != nil {
+			vlog.VLogfQuiet(m.Name, "Value %q doesn't look like an int: %s", m.Value, err)
+			return s, false
+		}
+		s.kind, s.i = signedCounter, i
+	case Float, Double:
+		f, err := strconv.ParseFloat(m.Value, 64)
+		if err != nil {
+			vlog.VLogfQuiet(m.Name, "Value %q doesn't look like a float: %s", m.Value, err)
+			return s, false
+		}
+		s.kind, s.f = floatCounter, f
+	default:
+		vlog.VLogfQuiet(m.Name, "Can't compute deltas for string metric %q", m.Value)
+		return s, false
+	}
+	return s, true
+}
+
+// rateTracker turns running totals into rates of change, for sinks whose
+// backends expect values to be reported that way.
+type rateTracker struct {
+	deltas deltaTracker
+}
+
+// rate returns a float metric with the rate of change per second of m since
+// its previous sample. ok is false if this is m's first sample, m isn't
+// numeric, or no time has passed since the previous sample.
+func (r *rateTracker) rate(m Metric, now time.Time) (rate Metric, ok bool) {
+	rate = Metric{Name: m.Name, Type: m.Type, Units: m.Units + "/sec", Rate: true}
+	delta, elapsed, ok := r.deltas.delta(m, now)
+	if !ok || elapsed <= 0 {
+		return rate, false
+	}
+	rate.Value = fmt.Sprint(delta / elapsed.Seconds())
+	if counterWidth(m.Type) != 0 {
+		// upgrade to a float to avoid loss of precision
+		rate.Type = Float
+	}
+	return rate, true
+}
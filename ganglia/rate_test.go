@@ -0,0 +1,92 @@
+package ganglia
+
+import (
+	"math"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRateTracker(t *testing.T) {
+	var r rateTracker
+	start := time.Now()
+	if _, ok := r.rate(Metric{Name: "n", Value: "10", Type: Uint, Units: "reqs", Rate: true}, start); ok {
+		t.Errorf("got a rate from the first sample")
+	}
+	m, ok := r.rate(Metric{Name: "n", Value: "30", Type: Uint, Units: "reqs", Rate: true}, start.Add(2*time.Second))
+	if !ok || m.Value != "10" || m.Type != Float || m.Units != "reqs/sec" {
+		t.Errorf("got rate %+v, %v, expected 10 reqs/sec", m, ok)
+	}
+	if _, ok := r.rate(Metric{Name: "n", Value: "40", Type: Uint, Rate: true}, start.Add(2*time.Second)); ok {
+		t.Errorf("got a rate from samples at the same time")
+	}
+	if _, ok := r.rate(Metric{Name: "s", Value: "x", Type: String, Rate: true}, start); ok {
+		t.Errorf("got a rate for a string metric")
+	}
+}
+
+func TestCounterDelta(t *testing.T) {
+	for _, test := range []struct {
+		prev, cur uint64
+		width     uint
+		limit     uint64
+		expected  uint64
+	}{
+		{10, 30, 32, math.MaxUint64, 20},
+		{math.MaxUint32 - 4, 5, 32, math.MaxUint64, 10},                    // wrapped
+		{math.MaxUint16, 0, 16, math.MaxUint64, 1},                         // wrapped
+		{1000, 5, 32, math.MaxUint64, 5},                                   // reset
+		{3000000000, 7, 32, math.MaxUint64, 7},                             // restart, not near the top
+		{math.MaxUint32 - 4, 1 << 30, 32, math.MaxUint64, 1 << 30},         // too far to have wrapped
+		{math.MaxUint32 - 4, 5, 32, 9, 5},                                  // faster than the limit
+		{math.MaxUint64 - 1, 1, 64, math.MaxUint64, 3},                     // wrapped
+		{1 << 40, 7, 64, math.MaxUint64, 7},                                // reset
+		{math.MaxUint32 + 10, math.MaxUint32 + 20, 64, math.MaxUint64, 10}, // beyond 32 bits
+	} {
+		if got := counterDelta(test.prev, test.cur, test.width, test.limit); got != test.expected {
+			t.Errorf("got delta %d from %d to %d at %d bits with limit %d, expected %d", got, test.prev, test.cur, test.width, test.limit, test.expected)
+		}
+	}
+}
+
+func TestDeltaTracker(t *testing.T) {
+	start := time.Now()
+	for _, test := range []struct {
+		name       string
+		metricType uint32
+		values     []string
+		expected   []float64 // deltas from the second value on
+	}{
+		{"uint32 wrap", Uint, []string{"4294967290", "4"}, []float64{10}},
+		{"uint32 reset", Uint, []string{"500", "20", "50"}, []float64{20, 30}},
+		{"uint32 restart", Uint, []string{"3000000000", "7"}, []float64{7}},
+		// near the top, but far faster than the counter was growing
+		{"uint32 implausible wrap", Uint, []string{"4294967000", "4294967010", "100"}, []float64{10, 100}},
+		{"uint32 plausible wrap", Uint, []string{"4294967000", "4294967100", "4"}, []float64{100, 200}},
+		{"ushort wrap", Ushort, []string{"65535", "1"}, []float64{2}},
+		// a Uint counter beyond 32 bits is tracked at 64 bits, even
+		// after falling back below 2^32
+		{"uint64", Uint, []string{"4294967290", "4294967300", strconv.FormatUint(math.MaxUint64, 10), "9", "10"}, []float64{10, math.MaxUint64 - 4294967300, 10, 1}},
+		{"int at max", Int, []string{"2147483647", "-2147483648"}, []float64{0}},
+		{"int decrease", Int, []string{"5", "-3", "2"}, []float64{0, 5}},
+		{"int negative", Int, []string{"-10", "-4"}, []float64{6}},
+		{"int64", Int, []string{"-9223372036854775808", "9223372036854775807"}, []float64{math.MaxUint64}},
+		{"short reset", Short, []string{"100", "3"}, []float64{3}},
+		{"float reset", Float, []string{"10.5", "2.5", "3"}, []float64{2.5, 0.5}},
+	} {
+		var d deltaTracker
+		for i, v := range test.values {
+			now := start.Add(time.Duration(i) * time.Second)
+			delta, elapsed, ok := d.delta(Metric{Name: "n", Value: v, Type: test.metricType, Rate: true}, now)
+			if i == 0 {
+				if ok {
+					t.Errorf("%s: got a delta from the first sample", test.name)
+				}
+				continue
+			}
+			if !ok || delta != test.expected[i-1] || elapsed != time.Second {
+				t.Errorf("%s: got delta %v over %s, %v to %s, expected %v over 1s", test.name, delta, elapsed, ok, v, test.expected[i-1])
+			}
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package ganglia
+
+import (
+	"fmt"
+
+	"github.com/fastly/go-utils/server"
+)
+
+// ServerGmetrics returns a ReporterCallback which reports the number of open
+// connections on each of s's listeners with TrackConns set in their
+// server.ListenerOptions, and the rate at which listeners with
+// server.ConnLimits reject connections, e.g.
+//
+//	AddGmetrics(ServerGmetrics(s))
+func ServerGmetrics(s *server.Server) ReporterCallback {
+	return func(gmetric MetricSender) {
+		for label, n := range s.ConnCounts() {
+			gmetric(serverMetricName("conns", label), fmt.Sprint(n), Uint, "conns", false)
+		}
+		for label, counts := range s.Rejections() {
+			for reason, n := range map[server.RejectReason]uint64{
+				server.RejectMaxConns: counts.MaxConns,
+				server.RejectRate:     counts.Rate,
+				server.RejectPerIP:    counts.PerIP,
+			} {
+				name := serverMetricName("conns_rejected_"+reason.String(), label)
+				gmetric(name, fmt.Sprint(n), Uint, "conns", true)
+			}
+		}
+	}
+}
+
+func serverMetricName(name, label string) string {
+	if label == server.SINGLE {
+		return name
+	}
+	return name + "_" + label
+}
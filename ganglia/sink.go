@@ -0,0 +1,72 @@
+package ganglia
+
+import (
+	"sync"
+	"time"
+)
+
+// Metric is one value sent to a MetricSender.
+type Metric struct {
+	Name  string
+	Value string
+	Type  uint32
+	Units string
+	// Rate is true if the value is a running total, whose rate of change
+	// should be reported.
+	Rate bool
+}
+
+// Batch is the metrics sent by one round of a Reporter's callbacks.
+type Batch struct {
+	// Prefix and Group are the prefix and group name set with Configure.
+	Prefix, Group string
+	// Interval is how often the Reporter collects metrics.
+	Interval time.Duration
+	// Dmax is the time metrics are valid for, as set with SetDmax.
+	Dmax time.Duration
+	// Time is when the metrics were collected.
+	Time    time.Time
+	Metrics []Metric
+}
+
+// A Sink is a destination for the metrics collected by a Reporter.
+type Sink interface {
+	// Publish sends the metrics in a batch. It may be called concurrently
+	// with the Publish methods of other sinks, but not with itself.
+	Publish(b *Batch) error
+}
+
+// MemorySink keeps the batches published to it, for tests.
+type MemorySink struct {
+	mu      sync.Mutex
+	batches []*Batch
+}
+
+func (s *MemorySink) Publish(b *Batch) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.batches = append(s.batches, b)
+	return nil
+}
+
+// Batches returns the batches published so far.
+func (s *MemorySink) Batches() []*Batch {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*Batch(nil), s.batches...)
+}
+
+// Latest returns the most recently published metric called name.
+func (s *MemorySink) Latest(name string) (m Metric, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := len(s.batches) - 1; i >= 0; i-- {
+		metrics := s.batches[i].Metrics
+		for j := len(metrics) - 1; j >= 0; j-- {
+			if metrics[j].Name == name {
+				return metrics[j], true
+			}
+		}
+	}
+	return Metric{}, false
+}
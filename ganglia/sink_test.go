@@ -0,0 +1,99 @@
+package ganglia
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReporterSinks(t *testing.T) {
+	var a, b MemorySink
+	gr := NewReporter(10*time.Millisecond, &a)
+	gr.AddSink(&b)
+	gr.Configure("group", "prefix_")
+	gr.AddCallback(func(gmetric MetricSender) {
+		gmetric("answer", "42", Uint, "things", false)
+	})
+	defer gr.Stop()
+
+	deadline := time.Now().Add(time.Second)
+	for len(a.Batches()) == 0 || len(b.Batches()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("sinks got no batches")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	for _, sink := range []*MemorySink{&a, &b} {
+		m, ok := sink.Latest("answer")
+		if !ok || m.Value != "42" || m.Type != Uint || m.Units != "things" {
+			t.Errorf("got %+v, %v from sink, expected answer=42", m, ok)
+		}
+		batch := sink.Batches()[0]
+		if batch.Prefix != "prefix_" || batch.Group != "group" || batch.Interval != 10*time.Millisecond {
+			t.Errorf("got batch %+v, expected configured prefix, group and interval", batch)
+		}
+	}
+}
+
+func TestGraphiteSink(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	lines := make(chan string, 10)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		s := bufio.NewScanner(conn)
+		for s.Scan() {
+			lines <- s.Text()
+		}
+	}()
+
+	s := NewGraphiteSink(l.Addr().String())
+	defer s.Close()
+	now := time.Unix(1500000000, 0)
+	batch := func(at time.Time, total string) *Batch {
+		return &Batch{Prefix: "app.", Group: "web tier", Time: at, Metrics: []Metric{
+			{Name: "conns", Value: "3", Type: Uint},
+			{Name: "version", Value: "1.2", Type: String},
+			{Name: "reqs", Value: total, Type: Uint, Rate: true},
+		}}
+	}
+	if err := s.Publish(batch(now, "100")); err != nil {
+		t.Fatalf("Publish: %s", err)
+	}
+	if err := s.Publish(batch(now.Add(10*time.Second), "150")); err != nil {
+		t.Fatalf("Publish: %s", err)
+	}
+	expected := []string{
+		"web_tier.app.conns 3 1500000000",
+		"web_tier.app.conns 3 1500000010",
+		"web_tier.app.reqs 5 1500000010",
+	}
+	for _, e := range expected {
+		select {
+		case line := <-lines:
+			if line != e {
+				t.Errorf("got line %q, expected %q", line, e)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %q", e)
+		}
+	}
+}
+
+func TestGraphitePath(t *testing.T) {
+	if p := graphitePath("", "a b/c"); p != "a_b_c" {
+		t.Errorf("got %q, expected a_b_c", p)
+	}
+	if p := graphitePath("g", "x.y"); !strings.HasPrefix(p, "g.") || p != "g.x.y" {
+		t.Errorf("got %q, expected g.x.y", p)
+	}
+}
@@ -0,0 +1,145 @@
+package ganglia
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// StatsdSink publishes metrics to a StatsD or DogStatsD server. Rate metrics
+// are sent as counters, incremented by how much their running totals have
+// grown since the previous batch, and others as gauges. Since StatsD takes
+// a signed gauge value as a change, a negative gauge is sent as zero
+// followed by its value. String metrics are skipped.
+type StatsdSink struct {
+	network, addr string
+
+	// DogStatsD, if true, sends the prefix and group set with Configure as
+	// the tags "prefix" and "group" instead of prepending the prefix to
+	// metric names. Plain StatsD doesn't support tags.
+	DogStatsD bool
+	// Tags are extra DogStatsD tags, such as "env:prod", sent with every
+	// metric if DogStatsD is true.
+	Tags []string
+	// MaxPacketSize is the largest datagram to send. Metrics are batched
+	// into datagrams of up to this size.
+	MaxPacketSize int
+
+	conn   net.Conn
+	deltas deltaTracker
+}
+
+// Default StatsdSink.MaxPacketSize for each transport. The UDP size keeps
+// packets within a typical Ethernet MTU.
+const (
+	StatsdUDPPacketSize  = 1432
+	StatsdUnixPacketSize = 8192
+)
+
+// NewStatsdSink returns a Sink which sends metrics to the StatsD server at
+// addr. addr is a UDP host:port, or the path of a unix datagram socket
+// prefixed by "unixgram:", e.g. "unixgram:/var/run/datadog/dsd.socket".
+func NewStatsdSink(addr string) *StatsdSink {
+	s := &StatsdSink{network: "udp", addr: addr, MaxPacketSize: StatsdUDPPacketSize}
+	if path := strings.TrimPrefix(addr, "unixgram:"); path != addr {
+		s.network, s.addr, s.MaxPacketSize = "unixgram", path, StatsdUnixPacketSize
+	}
+	return s
+}
+
+func (s *StatsdSink) Publish(b *Batch) error {
+	if s.conn == nil {
+		conn, err := net.Dial(s.network, s.addr)
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+
+	var tags []string
+	prefix := b.Prefix
+	if s.DogStatsD {
+		tags = append(tags, s.Tags...)
+		prefix = ""
+		if b.Prefix != "" {
+			tags = append(tags, "prefix:"+b.Prefix)
+		}
+		if b.Group != "" {
+			tags = append(tags, "group:"+b.Group)
+		}
+	}
+	var suffix string
+	if len(tags) > 0 {
+		for i, tag := range tags {
+			tags[i] = statsdTagEscaper.Replace(tag)
+		}
+		suffix = "|#" + strings.Join(tags, ",")
+	}
+
+	var packet bytes.Buffer
+	for _, m := range b.Metrics {
+		if m.Type == String {
+			continue
+		}
+		v, err := strconv.ParseFloat(m.Value, 64)
+		if err != nil {
+			continue
+		}
+		kind := "g"
+		if m.Rate {
+			// count what the total has grown by, allowing for resets
+			delta, _, ok := s.deltas.delta(m, b.Time)
+			if !ok {
+				continue
+			}
+			v, kind = delta, "c"
+		}
+		name := statsdNameEscaper.Replace(prefix + m.Name)
+		line := name + ":" + strconv.FormatFloat(v, 'f', -1, 64) + "|" + kind + suffix
+		if kind == "g" && v < 0 {
+			// a signed value would be taken as a change to the gauge, so
+			// zero it first, in the same packet
+			line = name + ":0|g" + suffix + "\n" + line
+		}
+
+		if packet.Len() > 0 && packet.Len()+1+len(line) > s.MaxPacketSize {
+			if err := s.send(packet.Bytes()); err != nil {
+				return err
+			}
+			packet.Reset()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+	if packet.Len() > 0 {
+		return s.send(packet.Bytes())
+	}
+	return nil
+}
+
+func (s *StatsdSink) send(packet []byte) error {
+	if _, err := s.conn.Write(packet); err != nil {
+		s.Close()
+		return err
+	}
+	return nil
+}
+
+// Close closes the connection to the server. It's reopened by the next call
+// to Publish.
+func (s *StatsdSink) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+var (
+	statsdNameEscaper = strings.NewReplacer(":", "_", "|", "_", "@", "_", "\n", "_")
+	statsdTagEscaper  = strings.NewReplacer(",", "_", "|", "_", "#", "_", "\n", "_")
+)
@@ -0,0 +1,192 @@
+package ganglia
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// statsdServer reads datagrams sent to conn.
+func statsdServer(conn net.PacketConn) chan string {
+	packets := make(chan string, 100)
+	go func() {
+		b := make([]byte, 65536)
+		for {
+			n, _, err := conn.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			packets <- string(b[:n])
+		}
+	}()
+	return packets
+}
+
+func readPacket(t *testing.T, packets chan string) string {
+	select {
+	case p := <-packets:
+		return p
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for a packet")
+	}
+	return ""
+}
+
+func TestStatsdSink(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	packets := statsdServer(conn)
+
+	s := NewStatsdSink(conn.LocalAddr().String())
+	defer s.Close()
+	batch := func(total string) *Batch {
+		return &Batch{Prefix: "app.", Group: "web", Metrics: []Metric{
+			{Name: "conns", Value: "3", Type: Uint},
+			{Name: "version", Value: "1.2", Type: String},
+			{Name: "reqs", Value: total, Type: Uint, Rate: true},
+			{Name: "load:avg", Value: "0.5", Type: Float},
+		}}
+	}
+	if err := s.Publish(batch("100")); err != nil {
+		t.Fatalf("Publish: %s", err)
+	}
+	if p, expected := readPacket(t, packets), "app.conns:3|g\napp.load_avg:0.5|g"; p != expected {
+		t.Errorf("got packet %q, expected %q", p, expected)
+	}
+	if err := s.Publish(batch("150")); err != nil {
+		t.Fatalf("Publish: %s", err)
+	}
+	if p, expected := readPacket(t, packets), "app.conns:3|g\napp.reqs:50|c\napp.load_avg:0.5|g"; p != expected {
+		t.Errorf("got packet %q, expected %q", p, expected)
+	}
+
+	// a reset counts from zero
+	if err := s.Publish(batch("20")); err != nil {
+		t.Fatalf("Publish: %s", err)
+	}
+	if p := readPacket(t, packets); !strings.Contains(p, "app.reqs:20|c") {
+		t.Errorf("got packet %q after counter reset, expected an increment of 20", p)
+	}
+}
+
+func TestDogStatsdTags(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	packets := statsdServer(conn)
+
+	s := NewStatsdSink(conn.LocalAddr().String())
+	s.DogStatsD = true
+	s.Tags = []string{"env:test"}
+	defer s.Close()
+	b := &Batch{Prefix: "app", Group: "web,tier", Metrics: []Metric{{Name: "conns", Value: "3", Type: Uint}}}
+	for i := 0; i < 2; i++ {
+		if err := s.Publish(b); err != nil {
+			t.Fatalf("Publish: %s", err)
+		}
+		if p, expected := readPacket(t, packets), "conns:3|g|#env:test,prefix:app,group:web_tier"; p != expected {
+			t.Errorf("got packet %q, expected %q", p, expected)
+		}
+	}
+}
+
+func TestStatsdTagsNeedDogStatsd(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	packets := statsdServer(conn)
+
+	s := NewStatsdSink(conn.LocalAddr().String())
+	s.Tags = []string{"env:test"}
+	defer s.Close()
+	if err := s.Publish(&Batch{Metrics: []Metric{{Name: "conns", Value: "3", Type: Uint}}}); err != nil {
+		t.Fatalf("Publish: %s", err)
+	}
+	if p := readPacket(t, packets); p != "conns:3|g" {
+		t.Errorf("got packet %q, expected no tags without DogStatsD", p)
+	}
+}
+
+func TestStatsdNegativeGauge(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	packets := statsdServer(conn)
+
+	s := NewStatsdSink(conn.LocalAddr().String())
+	s.DogStatsD = true
+	s.Tags = []string{"env:test"}
+	defer s.Close()
+	if err := s.Publish(&Batch{Metrics: []Metric{{Name: "temp", Value: "-5", Type: Int}}}); err != nil {
+		t.Fatalf("Publish: %s", err)
+	}
+	if p, expected := readPacket(t, packets), "temp:0|g|#env:test\ntemp:-5|g|#env:test"; p != expected {
+		t.Errorf("got packet %q, expected %q", p, expected)
+	}
+}
+
+func TestStatsdBatching(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	packets := statsdServer(conn)
+
+	s := NewStatsdSink(conn.LocalAddr().String())
+	s.MaxPacketSize = 30
+	defer s.Close()
+	b := &Batch{}
+	for _, name := range []string{"aaaaaaaa", "bbbbbbbb", "cccccccc", "dddddddd"} {
+		b.Metrics = append(b.Metrics, Metric{Name: name, Value: "1", Type: Uint})
+	}
+	if err := s.Publish(b); err != nil {
+		t.Fatalf("Publish: %s", err)
+	}
+	// each line is 12 bytes, so two fit in a packet with their separator
+	for _, expected := range []string{"aaaaaaaa:1|g\nbbbbbbbb:1|g", "cccccccc:1|g\ndddddddd:1|g"} {
+		if p := readPacket(t, packets); p != expected {
+			t.Errorf("got packet %q, expected %q", p, expected)
+		}
+	}
+}
+
+func TestStatsdUnixgram(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statsd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dsd.sock")
+	conn, err := net.ListenPacket("unixgram", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	packets := statsdServer(conn)
+
+	s := NewStatsdSink("unixgram:" + path)
+	defer s.Close()
+	if s.MaxPacketSize != StatsdUnixPacketSize {
+		t.Errorf("got MaxPacketSize %d for unixgram, expected %d", s.MaxPacketSize, StatsdUnixPacketSize)
+	}
+	if err := s.Publish(&Batch{Metrics: []Metric{{Name: "conns", Value: "3", Type: Uint}}}); err != nil {
+		t.Fatalf("Publish: %s", err)
+	}
+	if p := readPacket(t, packets); p != "conns:3|g" {
+		t.Errorf("got packet %q over unixgram", p)
+	}
+}
@@ -1,7 +1,10 @@
 package instrumentation
 
 import (
+	"bytes"
+	"fmt"
 	"runtime"
+	"sort"
 	"strings"
 	"syscall"
 	"time"
@@ -89,3 +92,86 @@ func GetStackTraces() map[string][]string {
 
 	return info
 }
+
+// GetStackSummary returns the trace of all goroutines with those running
+// identical code grouped together, so that e.g. thousands of goroutines
+// blocked in the same place produce one entry. Argument values are elided
+// from the stacks before comparing them. Groups are ordered largest first
+// and headed by the number of goroutines and their states.
+func GetStackSummary() string {
+	type group struct {
+		count  int
+		states map[string]bool
+		stack  string
+	}
+	groups := make(map[string]*group)
+
+	for _, block := range strings.Split(GetStackTrace(true), "\n\n") {
+		lines := strings.Split(strings.TrimSpace(block), "\n")
+		if len(lines) == 0 || !strings.HasPrefix(lines[0], "goroutine ") {
+			continue
+		}
+		state := ""
+		if i, j := strings.Index(lines[0], "["), strings.Index(lines[0], "]"); i >= 0 && j > i {
+			// drop durations like ", 5 minutes"
+			state = strings.SplitN(lines[0][i+1:j], ",", 2)[0]
+		}
+		for i := 1; i < len(lines); i++ {
+			lines[i] = elideStackLine(lines[i])
+		}
+		stack := strings.Join(lines[1:], "\n")
+		g, ok := groups[stack]
+		if !ok {
+			g = &group{states: make(map[string]bool), stack: stack}
+			groups[stack] = g
+		}
+		g.count++
+		g.states[state] = true
+	}
+
+	sorted := make([]*group, 0, len(groups))
+	for _, g := range groups {
+		sorted = append(sorted, g)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].count != sorted[j].count {
+			return sorted[i].count > sorted[j].count
+		}
+		return sorted[i].stack < sorted[j].stack
+	})
+
+	var b bytes.Buffer
+	for i, g := range sorted {
+		states := make([]string, 0, len(g.states))
+		for s := range g.states {
+			states = append(states, s)
+		}
+		sort.Strings(states)
+		noun := "goroutines"
+		if g.count == 1 {
+			noun = "goroutine"
+		}
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		fmt.Fprintf(&b, "%d %s [%s]:\n%s\n", g.count, noun, strings.Join(states, ", "), g.stack)
+	}
+	return b.String()
+}
+
+// elideStackLine removes the parts of a line of stack trace which differ
+// between goroutines running the same code.
+func elideStackLine(line string) string {
+	if strings.HasPrefix(line, "\t") {
+		return line // file:line +pc
+	}
+	if i := strings.Index(line, " in goroutine "); strings.HasPrefix(line, "created by ") && i >= 0 {
+		return line[:i]
+	}
+	if strings.HasSuffix(line, ")") {
+		if i := strings.LastIndex(line, "("); i >= 0 && i < len(line)-2 {
+			return line[:i] + "(...)"
+		}
+	}
+	return line
+}
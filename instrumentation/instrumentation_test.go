@@ -3,6 +3,9 @@ package instrumentation_test
 import (
 	"testing"
 
+	"regexp"
+	"time"
+
 	"github.com/fastly/go-utils/instrumentation"
 )
 
@@ -18,3 +21,22 @@ func TestGetStackTrace(t *testing.T) {
 func TestGetStackTraces(t *testing.T) {
 	instrumentation.GetStackTraces()
 }
+
+func TestGetStackSummary(t *testing.T) {
+	stop := make(chan struct{})
+	defer close(stop)
+	for i := 0; i < 5; i++ {
+		go func(i int) {
+			<-stop
+		}(i)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	summary := instrumentation.GetStackSummary()
+	if !regexp.MustCompile(`(?m)^([5-9]|\d\d+) goroutines \[chan receive\]:$`).MatchString(summary) {
+		t.Errorf("blocked goroutines weren't grouped together:\n%s", summary)
+	}
+	if regexp.MustCompile(`\(0x`).MatchString(summary) {
+		t.Errorf("argument values weren't elided:\n%s", summary)
+	}
+}
@@ -0,0 +1,65 @@
+package lifecycle
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fastly/go-utils/instrumentation"
+)
+
+// CrashDir is the directory in which Go writes crash reports. If it is empty,
+// crash reports are logged instead.
+var CrashDir string
+
+// Go runs f in a new goroutine. If f panics, the panic is recovered and a
+// crash report containing the panic value, the stacks of all goroutines and
+// the process's instrumentation.SystemStats is written to CrashDir. FatalQuit
+// is then called so that the usual shutdown sequence runs, and
+// RunUntilKilled reports ExitPanic.
+func (l *Lifecycle) Go(name string, f func()) {
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				l.crashed(name, r)
+			}
+		}()
+		f()
+	}()
+}
+
+func (l *Lifecycle) crashed(name string, r interface{}) {
+	now := time.Now()
+	report := crashReport(name, r, now)
+
+	if CrashDir == "" {
+		log.Printf("%s", report)
+	} else {
+		file := filepath.Join(CrashDir, fmt.Sprintf("%s-crash-%s.txt", filepath.Base(os.Args[0]), now.UTC().Format("20060102T150405.000000000Z")))
+		if err := ioutil.WriteFile(file, report, 0644); err != nil {
+			log.Printf("Couldn't write crash report: %s\n%s", err, report)
+		} else {
+			log.Printf("Goroutine %q panicked: %v; crash report written to %s", name, r, file)
+		}
+	}
+
+	l.m.Lock()
+	l.panicked = true
+	l.m.Unlock()
+	l.FatalQuit()
+}
+
+func crashReport(name string, r interface{}, when time.Time) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s (pid %d) goroutine %q panicked at %s\n", os.Args[0], os.Getpid(), name, when.Format(time.RFC3339Nano))
+	fmt.Fprintf(&b, "panic: %v [%T]\n\n", r, r)
+	b.WriteString(instrumentation.GetStackTrace(true))
+	stats, _ := json.MarshalIndent(instrumentation.GetSystemStats(), "", "  ")
+	fmt.Fprintf(&b, "\nsystem stats: %s\n", stats)
+	return b.Bytes()
+}
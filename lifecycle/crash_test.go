@@ -0,0 +1,59 @@
+package lifecycle
+
+import (
+	"testing"
+
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+func TestGoPanic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "crash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(dir string) { CrashDir = dir }(CrashDir)
+	CrashDir = dir
+
+	var signals ManualSignals
+	l := NewWithSignalSource(false, &signals)
+	killed := false
+	l.AddKillFunc(func() { killed = true })
+
+	for i := 0; i < 2; i++ {
+		l.Go("worker", func() {
+			panic("out of widgets")
+		})
+	}
+	if status := l.RunUntilKilled(nil, time.Second); status != ExitPanic {
+		t.Errorf("got status %v, expected %v", status, ExitPanic)
+	}
+	if !killed {
+		t.Errorf("kill funcs didn't run after panic")
+	}
+	if ExitPanic.Code() == 0 {
+		t.Errorf("panics shouldn't exit cleanly")
+	}
+
+	var reports []string
+	for deadline := time.Now().Add(time.Second); len(reports) < 2 && time.Now().Before(deadline); {
+		time.Sleep(5 * time.Millisecond)
+		reports, _ = filepath.Glob(filepath.Join(dir, "*-crash-*.txt"))
+	}
+	if len(reports) != 2 {
+		t.Fatalf("got crash reports %v, expected 2", reports)
+	}
+	b, err := ioutil.ReadFile(reports[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{`goroutine "worker" panicked`, "panic: out of widgets [string]", "TestGoPanic", `"NumGoRoutines"`} {
+		if !strings.Contains(string(b), s) {
+			t.Errorf("crash report doesn't contain %q:\n%s", s, b)
+		}
+	}
+}
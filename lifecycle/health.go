@@ -0,0 +1,154 @@
+package lifecycle
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/fastly/go-utils/vlog"
+)
+
+// State is the phase of its life a daemon managed by a Lifecycle is in.
+type State int
+
+const (
+	// StateStarting is the state of a new Lifecycle, until SetReady is called.
+	StateStarting State = iota
+	// StateReady means the daemon is serving.
+	StateReady
+	// StateDraining means a shutdown signal has been received and the
+	// finalizer and shutdown phases are running.
+	StateDraining
+	// StateStopping means the kill funcs are running.
+	StateStopping
+)
+
+func (s State) String() string {
+	switch s {
+	case StateStarting:
+		return "starting"
+	case StateReady:
+		return "ready"
+	case StateDraining:
+		return "draining"
+	case StateStopping:
+		return "stopping"
+	}
+	return fmt.Sprintf("State(%d)", int(s))
+}
+
+// MarshalText encodes s as its name.
+func (s State) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText decodes a State encoded by MarshalText.
+func (s *State) UnmarshalText(b []byte) error {
+	for st := StateStarting; st <= StateStopping; st++ {
+		if st.String() == string(b) {
+			*s = st
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown state %q", b)
+}
+
+type healthCheck struct {
+	name  string
+	check func() error
+}
+
+// State returns the current state of l.
+func (l *Lifecycle) State() State {
+	l.m.Lock()
+	defer l.m.Unlock()
+	return l.state
+}
+
+// SetReady marks the daemon as ready to serve once startup has finished. It
+// has no effect once shutdown has begun.
+func (l *Lifecycle) SetReady() {
+	l.setState(StateReady)
+}
+
+// setState moves l to s. States only ever advance, so late or repeated
+// transitions are ignored.
+func (l *Lifecycle) setState(s State) {
+	l.m.Lock()
+	if s <= l.state {
+		l.m.Unlock()
+		return
+	}
+	vlog.VLogf("Lifecycle state %s -> %s", l.state, s)
+	l.state = s
+	upgraded := l.upgraded
+	l.m.Unlock()
+	notifySystemd(s, upgraded)
+}
+
+// AddHealthCheck registers a named check which is run each time the health
+// endpoints are requested. A non-nil error marks the daemon unhealthy and is
+// included in the response.
+func (l *Lifecycle) AddHealthCheck(name string, check func() error) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	l.healthChecks = append(l.healthChecks, healthCheck{name, check})
+}
+
+// HealthStatus is the JSON body served by HealthHandler.
+type HealthStatus struct {
+	OK     bool              `json:"ok"`
+	State  State             `json:"state"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+// Health runs the registered health checks. If ready is true, the daemon
+// must also be in StateReady to be considered OK.
+func (l *Lifecycle) Health(ready bool) HealthStatus {
+	l.m.Lock()
+	checks := append([]healthCheck(nil), l.healthChecks...)
+	state := l.state
+	l.m.Unlock()
+
+	h := HealthStatus{OK: true, State: state}
+	if ready && state != StateReady {
+		h.OK = false
+	}
+	if len(checks) > 0 {
+		h.Checks = make(map[string]string, len(checks))
+	}
+	for _, c := range checks {
+		if err := c.check(); err != nil {
+			h.OK = false
+			h.Checks[c.name] = err.Error()
+		} else {
+			h.Checks[c.name] = "ok"
+		}
+	}
+	return h
+}
+
+// HealthHandler returns an http.Handler serving JSON health reports. Requests
+// for /healthz are answered with 200 unless a health check fails; requests
+// for /readyz also fail unless the daemon is in StateReady, so load balancers
+// stop sending traffic as soon as a shutdown signal is caught. Unhealthy
+// reports have status 503.
+func (l *Lifecycle) HealthHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		serveHealth(w, l.Health(false))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		serveHealth(w, l.Health(true))
+	})
+	return mux
+}
+
+func serveHealth(w http.ResponseWriter, h HealthStatus) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	if !h.OK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(h)
+}
@@ -0,0 +1,80 @@
+package lifecycle
+
+import (
+	"testing"
+
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+)
+
+func getHealth(t *testing.T, h http.Handler, path string) (int, HealthStatus) {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+	var status HealthStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatalf("bad JSON from %s: %s: %q", path, err, w.Body.String())
+	}
+	return w.Code, status
+}
+
+func TestHealthHandler(t *testing.T) {
+	var signals ManualSignals
+	l := NewWithSignalSource(false, &signals)
+	h := l.HealthHandler()
+
+	var mu sync.Mutex
+	var dbErr error
+	l.AddHealthCheck("db", func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		return dbErr
+	})
+
+	if code, status := getHealth(t, h, "/healthz"); code != http.StatusOK || status.State != StateStarting {
+		t.Errorf("/healthz while starting: got %d %+v", code, status)
+	}
+	if code, _ := getHealth(t, h, "/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("/readyz while starting: got %d, expected 503", code)
+	}
+
+	l.SetReady()
+	if code, status := getHealth(t, h, "/readyz"); code != http.StatusOK || status.Checks["db"] != "ok" {
+		t.Errorf("/readyz when ready: got %d %+v", code, status)
+	}
+
+	mu.Lock()
+	dbErr = errors.New("connection refused")
+	mu.Unlock()
+	if code, status := getHealth(t, h, "/healthz"); code != http.StatusServiceUnavailable || status.Checks["db"] != "connection refused" {
+		t.Errorf("/healthz with failing check: got %d %+v", code, status)
+	}
+	mu.Lock()
+	dbErr = nil
+	mu.Unlock()
+
+	// readiness must flip before the finalizer runs
+	l.AddKillFunc(func() {
+		if code, _ := getHealth(t, h, "/healthz"); code != http.StatusOK {
+			t.Errorf("/healthz while stopping: got %d, expected 200", code)
+		}
+	})
+	signals.Send(os.Interrupt)
+	l.RunUntilKilled(func() {
+		if code, status := getHealth(t, h, "/readyz"); code != http.StatusServiceUnavailable || status.State != StateDraining {
+			t.Errorf("/readyz while draining: got %d %+v", code, status)
+		}
+	}, 0)
+	if s := l.State(); s != StateStopping {
+		t.Errorf("got state %v after shutdown, expected %v", s, StateStopping)
+	}
+
+	// states never go backwards
+	l.SetReady()
+	if s := l.State(); s != StateStopping {
+		t.Errorf("SetReady after shutdown changed state to %v", s)
+	}
+}
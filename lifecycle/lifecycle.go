@@ -1,59 +1,200 @@
 package lifecycle
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"os"
-	"os/signal"
 	"sync"
 	"syscall"
 	"time"
 
-	"github.com/fastly/go-utils/executable"
-	"github.com/fastly/go-utils/instrumentation"
-	"github.com/fastly/go-utils/stopper"
 	"github.com/fastly/go-utils/vlog"
 )
 
-const traceSignal = syscall.SIGUSR1
-
 // A Lifecycle manages some boilerplate for running daemons.
 type Lifecycle struct {
 	m         sync.Mutex
+	signals   SignalSource
 	interrupt chan os.Signal
 	fatalQuit chan struct{}
-	killFuncs []func()
+	killFuncs []func(context.Context)
+
+	shutdownSignals []os.Signal
+	subscribed      chan os.Signal // forwarded to interrupt
+	handled         chan os.Signal
+	handlers        map[os.Signal][]func(os.Signal)
+
+	phases []*shutdownPhase
+	report []HookResult
+
+	pidLock *PidLock
+
+	state        State
+	healthChecks []healthCheck
+
+	panicked bool
+	upgraded bool // handed over to a new process by UpgradeOn
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// ExitStatus describes how the shutdown performed by RunUntilKilled ended.
+type ExitStatus int
+
+const (
+	// ExitClean means a shutdown signal was received and the finalizer and
+	// kill funcs all completed.
+	ExitClean ExitStatus = iota
+	// ExitFatalQuit means FatalQuit started the shutdown, which then
+	// completed.
+	ExitFatalQuit
+	// ExitTimeout means the finalizer and kill funcs didn't complete within
+	// the shutdown timeout.
+	ExitTimeout
+	// ExitSecondInterrupt means another shutdown signal arrived before the
+	// finalizer and kill funcs completed.
+	ExitSecondInterrupt
+	// ExitPanic means a goroutine started with Go panicked, which started
+	// the shutdown.
+	ExitPanic
+)
+
+func (s ExitStatus) String() string {
+	switch s {
+	case ExitClean:
+		return "clean"
+	case ExitFatalQuit:
+		return "fatal quit"
+	case ExitTimeout:
+		return "timeout"
+	case ExitSecondInterrupt:
+		return "second interrupt"
+	case ExitPanic:
+		return "panic"
+	}
+	return fmt.Sprintf("ExitStatus(%d)", int(s))
+}
+
+// Code returns the process exit code RunWhenKilled uses for s. Shutdowns
+// which complete, including those started by FatalQuit, exit with 0.
+func (s ExitStatus) Code() int {
+	switch s {
+	case ExitClean, ExitFatalQuit:
+		return 0
+	}
+	return 1
 }
 
+// DefaultShutdownSignals are the signals which New registers to trigger a
+// clean shutdown.
+var DefaultShutdownSignals = []os.Signal{os.Interrupt, syscall.SIGTERM, syscall.SIGHUP}
+
 // New creates a new Lifecycle. This should be called after validating
 // parameters but before starting work or allocating external resources. A
-// startup message is displayed and shutdown handlers for SIGINT and SIGTERM
-// are registered.
+// startup message is displayed and shutdown handlers for
+// DefaultShutdownSignals are registered. Use SetShutdownSignals or
+// HandleSignal to change which signals shut the daemon down.
 //
-// If New is passed 'true' for singleProcess, it will wait for existing duplicate
-// processes to exit before returning.
+// If New is passed 'true' for singleProcess, it takes a lock on a pid file
+// named after the binary in PidDir, waiting for any existing process holding
+// it to exit before returning. The lock is held until RunWhenKilled finishes.
 func New(singleProcess bool) *Lifecycle {
+	return NewWithSignalSource(singleProcess, OSSignals)
+}
+
+// NewWithSignalSource is New, but shutdown signals are taken from src instead
+// of the os/signal package.
+func NewWithSignalSource(singleProcess bool, src SignalSource) *Lifecycle {
 	l := Lifecycle{
+		signals:   src,
 		interrupt: make(chan os.Signal, 1),
 		fatalQuit: make(chan struct{}, 1),
+		handled:   make(chan os.Signal, 1),
+		handlers:  make(map[os.Signal][]func(os.Signal)),
 	}
+	l.ctx, l.cancel = context.WithCancel(context.Background())
 
 	// make sigint trigger a clean shutdown
-	signal.Notify(l.interrupt, os.Interrupt)
-	signal.Notify(l.interrupt, syscall.SIGTERM)
-	signal.Notify(l.interrupt, syscall.SIGHUP)
+	l.SetShutdownSignals(DefaultShutdownSignals...)
+
+	// don't pass on to our own children that we were started by UpgradeOn
+	_, upgraded := os.LookupEnv(upgradeEnv)
+	os.Unsetenv(upgradeEnv)
+	if singleProcess {
+		if upgraded {
+			l.lockAfterUpgrade()
+		} else {
+			l.lockSingleProcess()
+		}
+	}
+	l.startWatchdog()
 
-	if singleProcess && executable.NowRunning() {
-		vlog.VLogf("Waiting for existing %s processes to exit...", os.Args[0])
-		for executable.NowRunning() {
+	return &l
+}
+
+// lockSingleProcess takes the pid lock for this binary, waiting up to PidWait
+// for another instance to release it.
+func (l *Lifecycle) lockSingleProcess() {
+	path := defaultPidPath()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if PidWait > 0 {
+		ctx, cancel = context.WithTimeout(ctx, PidWait)
+		defer cancel()
+	}
+
+	lock, err := tryPidLock(path)
+	if _, ok := err.(*LockedError); ok {
+		vlog.VLogf("Waiting for existing %s process to exit: %s", os.Args[0], err)
+		go func() {
 			select {
 			case <-l.interrupt:
 				log.Fatalf("Aborting")
-			case <-time.After(100 * time.Millisecond):
+			case <-ctx.Done():
 			}
-		}
+		}()
+		lock, err = AcquirePidLock(ctx, path)
+	}
+	if err != nil {
+		log.Fatalf("Couldn't become the single %s process: %s", os.Args[0], err)
 	}
+	l.pidLock = lock
+}
 
-	return &l
+// lockAfterUpgrade takes the pid lock in the background, in a process started
+// by UpgradeOn. The process which started it holds the lock until this one is
+// ready and it has shut down, so waiting for the lock in New would stall the
+// upgrade until it timed out.
+func (l *Lifecycle) lockAfterUpgrade() {
+	path := defaultPidPath()
+	vlog.VLogf("Taking over %s once the upgraded process exits", path)
+	go func() {
+		lock, err := AcquirePidLock(l.ctx, path)
+		if err != nil {
+			if l.ctx.Err() == nil {
+				log.Printf("Couldn't take over %s: %s", path, err)
+			}
+			return
+		}
+		l.m.Lock()
+		defer l.m.Unlock()
+		if l.ctx.Err() != nil {
+			// shutting down already
+			lock.Release()
+			return
+		}
+		l.pidLock = lock
+	}()
+}
+
+// releasePidLock releases the pid lock, if it's held.
+func (l *Lifecycle) releasePidLock() {
+	l.m.Lock()
+	defer l.m.Unlock()
+	l.pidLock.Release()
+	l.pidLock = nil
 }
 
 // RunWhenKilled blocks until a shutdown signal is received, then executes
@@ -66,15 +207,52 @@ func New(singleProcess bool) *Lifecycle {
 //
 // RunWhenKilled runs the finalizer before any deferred AddKillFunc functions.
 // This is so that the finalizer can begin the shutdown process that any
-// other AddKillFunc functions can rely on.
+// other AddKillFunc functions can rely on. Shutdown phases declared with
+// AddPhase and AddShutdownHook run between the two.
 func (l *Lifecycle) RunWhenKilled(finalizer func(), timeout time.Duration) {
+	os.Exit(l.RunUntilKilled(finalizer, timeout).Code())
+}
+
+// RunUntilKilled is RunWhenKilled, except that rather than exiting the
+// process it returns a status describing how the shutdown ended. If the
+// status is ExitTimeout or ExitSecondInterrupt, the finalizer or kill funcs
+// may still be running; the context passed to kill funcs is cancelled before
+// RunUntilKilled returns.
+func (l *Lifecycle) RunUntilKilled(finalizer func(), timeout time.Duration) ExitStatus {
+	defer l.stopShutdownSignals()
+	defer l.releasePidLock()
+
 	vlog.VLogf("%s started", os.Args[0])
+	status := ExitClean
 	select {
 	case sig := <-l.interrupt:
 		vlog.VLogf("Caught signal %q, shutting down", sig)
 	case <-l.fatalQuit:
 		vlog.VLogf("Caught fatal quit, shutting down")
+		status = ExitFatalQuit
+		l.m.Lock()
+		if l.panicked {
+			status = ExitPanic
+		}
+		l.m.Unlock()
 	}
+	l.setState(StateDraining)
+	l.cancel()
+
+	// kill funcs share whatever is left of the shutdown budget
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if timeout > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, timeout)
+		defer cancelTimeout()
+	}
+
+	l.m.Lock()
+	killFuncs := make([]func(context.Context), len(l.killFuncs))
+	copy(killFuncs, l.killFuncs)
+	l.m.Unlock()
+	phases := l.snapshotPhases()
 
 	// wait for either confirmation that we finished or another interrupt
 	shutdown := make(chan struct{}, 1)
@@ -82,25 +260,23 @@ func (l *Lifecycle) RunWhenKilled(finalizer func(), timeout time.Duration) {
 		if finalizer != nil {
 			finalizer()
 		}
-		for i := len(l.killFuncs) - 1; i >= 0; i-- {
-			l.killFuncs[i]()
+		l.runPhases(ctx, phases)
+		l.setState(StateStopping)
+		for i := len(killFuncs) - 1; i >= 0; i-- {
+			killFuncs[i](ctx)
 		}
 		close(shutdown)
 	}()
-	var t <-chan time.Time
-	if timeout > 0 {
-		t = time.After(timeout)
-	}
 	select {
 	case <-shutdown:
 		vlog.VLogf("Shutdown complete, goodbye")
-		os.Exit(0)
-	case <-t:
+		return status
+	case <-ctx.Done():
 		vlog.VLogf("Shutdown timeout exceeded (%v)", timeout)
-		os.Exit(1)
+		return ExitTimeout
 	case <-l.interrupt:
 		vlog.VLogf("Second interrupt, exiting")
-		os.Exit(1)
+		return ExitSecondInterrupt
 	}
 }
 
@@ -110,39 +286,140 @@ func (l *Lifecycle) RunWhenKilled(finalizer func(), timeout time.Duration) {
 // is being killed ad the same time AddKillFunc is called, the
 // passed function will not be called.
 func (l *Lifecycle) AddKillFunc(f func()) {
+	l.AddKillFuncContext(func(context.Context) { f() })
+}
+
+// AddKillFuncContext is like AddKillFunc, but f is passed a context whose
+// deadline is the end of the shutdown timeout given to RunWhenKilled. Kill
+// funcs which can't finish in time should watch ctx.Done() and return early
+// rather than be cut off when the process exits.
+func (l *Lifecycle) AddKillFuncContext(f func(ctx context.Context)) {
 	l.m.Lock()
 	defer l.m.Unlock()
 	l.killFuncs = append(l.killFuncs, f)
 }
 
-// FatalQuit will kill the lifecycle to continue into the RunWhenKilled function.
-func (l *Lifecycle) FatalQuit() {
-	l.fatalQuit <- struct{}{}
+// Context returns a context which is cancelled as soon as a shutdown signal
+// or FatalQuit is received. Long-running work started by the daemon can use
+// it to notice that shutdown has begun.
+func (l *Lifecycle) Context() context.Context {
+	return l.ctx
 }
 
-// for debugging, show goroutine trace on receipt of USR1. uninstall by calling
-// Stop on the returned object
-func InstallStackTracer() stopper.Stopper {
-	signals := make(chan os.Signal, 1)
-	signal.Notify(signals, traceSignal)
-	stopper := stopper.NewChanStopper()
-	go func() {
-		defer func() {
-			signal.Stop(signals)
-			close(signals)
-		}()
-		for {
-			select {
-			case <-signals:
-				log.Print(instrumentation.GetStackTrace(true))
-			case <-stopper.Chan:
-				return
+// SetShutdownSignals replaces the set of signals which cause RunWhenKilled to
+// begin shutting down. Signals which have a handler registered with
+// HandleSignal are never treated as shutdown signals.
+func (l *Lifecycle) SetShutdownSignals(sigs ...os.Signal) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	l.shutdownSignals = append([]os.Signal(nil), sigs...)
+	l.notifyShutdownSignals()
+}
+
+// HandleSignal arranges for f to be called each time sig is received, until
+// shutdown begins. If sig was a shutdown signal it no longer is. Handlers run
+// one at a time on a separate goroutine, in the order they were registered,
+// so a slow handler delays later signals but never RunWhenKilled.
+func (l *Lifecycle) HandleSignal(sig os.Signal, f func(os.Signal)) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	first := len(l.handlers) == 0
+	if _, ok := l.handlers[sig]; !ok {
+		l.signals.Notify(l.handled, sig)
+	}
+	l.handlers[sig] = append(l.handlers[sig], f)
+	l.notifyShutdownSignals()
+	if first {
+		go l.dispatchSignals()
+	}
+}
+
+// OnReload registers f to be called on receipt of SIGHUP, which is the
+// conventional request for a daemon to reload its configuration. SIGHUP will
+// no longer shut the daemon down.
+func (l *Lifecycle) OnReload(f func()) {
+	l.HandleSignal(syscall.SIGHUP, func(os.Signal) {
+		l.notifySystemdReload(true)
+		defer l.notifySystemdReload(false)
+		f()
+	})
+}
+
+// notifyShutdownSignals points the shutdown signals without handlers at
+// l.interrupt. The new set is subscribed on a fresh channel before the old
+// one is let go, so that a signal in both is never left to its default
+// action, which for most would kill the process. l.m must be held.
+func (l *Lifecycle) notifyShutdownSignals() {
+	var sigs []os.Signal
+	for _, sig := range l.shutdownSignals {
+		if _, ok := l.handlers[sig]; !ok {
+			sigs = append(sigs, sig)
+		}
+	}
+	c := make(chan os.Signal, 1)
+	// an empty list would subscribe to every signal
+	if len(sigs) > 0 {
+		l.signals.Notify(c, sigs...)
+	}
+	l.stopSubscribed()
+	l.subscribed = c
+	go l.forwardShutdownSignals(c)
+}
+
+// forwardShutdownSignals passes signals from c to l.interrupt until c is
+// closed. Like os/signal, it drops signals rather than block.
+func (l *Lifecycle) forwardShutdownSignals(c chan os.Signal) {
+	for sig := range c {
+		select {
+		case l.interrupt <- sig:
+		default:
+		}
+	}
+}
+
+// stopShutdownSignals unsubscribes from the shutdown signals.
+func (l *Lifecycle) stopShutdownSignals() {
+	l.m.Lock()
+	defer l.m.Unlock()
+	l.stopSubscribed()
+}
+
+// stopSubscribed unsubscribes l.subscribed and closes it, so that its
+// forwarder exits once it has passed on any signal still buffered. l.m must
+// be held.
+func (l *Lifecycle) stopSubscribed() {
+	if l.subscribed == nil {
+		return
+	}
+	// once Stop returns, nothing more is sent on the channel
+	l.signals.Stop(l.subscribed)
+	close(l.subscribed)
+	l.subscribed = nil
+}
+
+func (l *Lifecycle) dispatchSignals() {
+	defer l.signals.Stop(l.handled)
+	for {
+		select {
+		case sig := <-l.handled:
+			l.m.Lock()
+			handlers := l.handlers[sig]
+			l.m.Unlock()
+			vlog.VLogf("Caught signal %q, running %d handler(s)", sig, len(handlers))
+			for _, f := range handlers {
+				f(sig)
 			}
+		case <-l.ctx.Done():
+			return
 		}
-	}()
-	return stopper
+	}
 }
 
-func GetStackTrace(all bool) string {
-	return instrumentation.GetStackTrace(all)
+// FatalQuit will kill the lifecycle to continue into the RunWhenKilled function.
+// It doesn't block, so it may be called more than once.
+func (l *Lifecycle) FatalQuit() {
+	select {
+	case l.fatalQuit <- struct{}{}:
+	default:
+	}
 }
@@ -3,7 +3,10 @@ package lifecycle
 import (
 	"testing"
 
+	"context"
+	"errors"
 	"os"
+	"syscall"
 	"time"
 )
 
@@ -12,43 +15,27 @@ func TestRunWhenKilled(t *testing.T) {
 	finalFunc := func() {
 		i++
 	}
-	l := New(true)
-	go func() {
-		l.RunWhenKilled(finalFunc, 100*time.Millisecond)
-	}()
-	proc, err := os.FindProcess(os.Getpid())
-	if err != nil {
-		t.Fatalf("%v", err)
+	var signals ManualSignals
+	l := NewWithSignalSource(true, &signals)
+	signals.Send(os.Interrupt)
+	if status := l.RunUntilKilled(finalFunc, 100*time.Millisecond); status != ExitClean {
+		t.Errorf("got status %v, expected %v", status, ExitClean)
 	}
-	proc.Signal(os.Interrupt)
-	time.Sleep(time.Millisecond)
 	if i != 1 {
 		t.Errorf("got %v != expect 1", i)
 	}
 }
 
 func TestAddKillFunc(t *testing.T) {
-	i := 0
-	addKillFunc := func() {
-		i++
-	}
-	done := make(chan struct{})
-	go func() {
-		l := New(true)
-		defer l.RunWhenKilled(func() {
-			done <- struct{}{}
-		}, 100*time.Millisecond)
-
-		l.AddKillFunc(addKillFunc)
-	}()
-	proc, err := os.FindProcess(os.Getpid())
-	if err != nil {
-		t.Fatalf("%v", err)
-	}
-	proc.Signal(os.Interrupt)
-	<-done
-	if i != 1 {
-		t.Errorf("got %v, != expect 1", i)
+	var order []int
+	var signals ManualSignals
+	l := NewWithSignalSource(true, &signals)
+	l.AddKillFunc(func() { order = append(order, 1) })
+	l.AddKillFunc(func() { order = append(order, 2) })
+	signals.Send(syscall.SIGTERM)
+	l.RunUntilKilled(func() { order = append(order, 0) }, 100*time.Millisecond)
+	if len(order) != 3 || order[0] != 0 || order[1] != 2 || order[2] != 1 {
+		t.Errorf("got order %v, expected [0 2 1]", order)
 	}
 }
 
@@ -57,24 +44,246 @@ func TestFatalQuit(t *testing.T) {
 	finalFunc := func() {
 		i++
 	}
-	done := make(chan struct{})
+	var signals ManualSignals
+	l := NewWithSignalSource(true, &signals)
+	done := make(chan struct{}, 1)
+	l.AddKillFunc(func() {
+		done <- struct{}{}
+	})
 	go func() {
-		l := New(true)
-		defer l.RunWhenKilled(finalFunc, 100*time.Millisecond)
-		l.AddKillFunc(func() {
-			done <- struct{}{}
-		})
-		go func() {
-			l.FatalQuit()
-		}()
+		l.FatalQuit()
 	}()
-	proc, err := os.FindProcess(os.Getpid())
-	if err != nil {
-		t.Fatalf("%v", err)
+	if status := l.RunUntilKilled(finalFunc, 100*time.Millisecond); status != ExitFatalQuit {
+		t.Errorf("got status %v, expected %v", status, ExitFatalQuit)
 	}
-	proc.Signal(os.Interrupt)
 	<-done
 	if i != 1 {
 		t.Errorf("got %v, != expect 1", i)
 	}
 }
+
+func TestShutdownTimeout(t *testing.T) {
+	var signals ManualSignals
+	l := NewWithSignalSource(false, &signals)
+	deadline := make(chan bool, 1)
+	l.AddKillFuncContext(func(ctx context.Context) {
+		_, ok := ctx.Deadline()
+		deadline <- ok
+		<-ctx.Done()
+		time.Sleep(time.Second)
+	})
+	signals.Send(os.Interrupt)
+	start := time.Now()
+	if status := l.RunUntilKilled(nil, 50*time.Millisecond); status != ExitTimeout {
+		t.Errorf("got status %v, expected %v", status, ExitTimeout)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("shutdown took %v, expected about 50ms", elapsed)
+	}
+	if !<-deadline {
+		t.Errorf("kill func context has no deadline")
+	}
+}
+
+func TestSecondInterrupt(t *testing.T) {
+	var signals ManualSignals
+	l := NewWithSignalSource(false, &signals)
+	stuck := make(chan struct{})
+	defer close(stuck)
+	cancelled := make(chan struct{})
+	l.AddKillFuncContext(func(ctx context.Context) {
+		signals.Send(os.Interrupt)
+		<-ctx.Done()
+		close(cancelled)
+		<-stuck
+	})
+	signals.Send(os.Interrupt)
+	if status := l.RunUntilKilled(nil, 0); status != ExitSecondInterrupt {
+		t.Errorf("got status %v, expected %v", status, ExitSecondInterrupt)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Errorf("kill func context wasn't cancelled")
+	}
+	if code := ExitSecondInterrupt.Code(); code != 1 {
+		t.Errorf("got exit code %d, expected 1", code)
+	}
+}
+
+func TestContext(t *testing.T) {
+	var signals ManualSignals
+	l := NewWithSignalSource(false, &signals)
+	if err := l.Context().Err(); err != nil {
+		t.Fatalf("context done before shutdown: %s", err)
+	}
+	l.AddKillFunc(func() {
+		if l.Context().Err() == nil {
+			t.Errorf("context not cancelled during shutdown")
+		}
+	})
+	signals.Send(syscall.SIGHUP)
+	l.RunUntilKilled(nil, 0)
+}
+
+func TestManualSignalsIgnoresUnregistered(t *testing.T) {
+	var signals ManualSignals
+	c := make(chan os.Signal, 1)
+	signals.Notify(c, syscall.SIGUSR2)
+	signals.Send(syscall.SIGUSR1)
+	select {
+	case sig := <-c:
+		t.Fatalf("got unexpected signal %v", sig)
+	default:
+	}
+	signals.Send(syscall.SIGUSR2)
+	if sig := <-c; sig != syscall.SIGUSR2 {
+		t.Errorf("got %v, expected %v", sig, syscall.SIGUSR2)
+	}
+	signals.Stop(c)
+	signals.Send(syscall.SIGUSR2)
+	if len(c) != 0 {
+		t.Errorf("got signal after Stop")
+	}
+}
+
+func TestOnReload(t *testing.T) {
+	var signals ManualSignals
+	l := NewWithSignalSource(false, &signals)
+	reloaded := make(chan struct{}, 1)
+	l.OnReload(func() { reloaded <- struct{}{} })
+
+	status := make(chan ExitStatus, 1)
+	go func() { status <- l.RunUntilKilled(nil, 0) }()
+
+	for i := 0; i < 2; i++ {
+		signals.Send(syscall.SIGHUP)
+		select {
+		case <-reloaded:
+		case <-time.After(time.Second):
+			t.Fatalf("reload handler wasn't called")
+		}
+	}
+	select {
+	case s := <-status:
+		t.Fatalf("SIGHUP caused shutdown with status %v", s)
+	default:
+	}
+
+	signals.Send(syscall.SIGTERM)
+	if s := <-status; s != ExitClean {
+		t.Errorf("got status %v, expected %v", s, ExitClean)
+	}
+}
+
+func TestSetShutdownSignals(t *testing.T) {
+	var signals ManualSignals
+	l := NewWithSignalSource(false, &signals)
+	l.SetShutdownSignals(syscall.SIGUSR2)
+
+	status := make(chan ExitStatus, 1)
+	go func() { status <- l.RunUntilKilled(nil, 0) }()
+
+	signals.Send(os.Interrupt)
+	select {
+	case s := <-status:
+		t.Fatalf("SIGINT caused shutdown with status %v", s)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	signals.Send(syscall.SIGUSR2)
+	if s := <-status; s != ExitClean {
+		t.Errorf("got status %v, expected %v", s, ExitClean)
+	}
+}
+
+// gapCheckingSignals is ManualSignals, but records signals which were left
+// without any subscriber, and so to their default action, by a call to Stop.
+type gapCheckingSignals struct {
+	ManualSignals
+	uncovered []os.Signal
+}
+
+func (g *gapCheckingSignals) Stop(c chan<- os.Signal) {
+	g.mu.Lock()
+	for _, sig := range g.chans[c] {
+		covered := false
+		for other, sigs := range g.chans {
+			if other != c && wants(sigs, sig) {
+				covered = true
+			}
+		}
+		if !covered {
+			g.uncovered = append(g.uncovered, sig)
+		}
+	}
+	g.mu.Unlock()
+	g.ManualSignals.Stop(c)
+}
+
+func TestShutdownSignalsStaySubscribed(t *testing.T) {
+	var signals gapCheckingSignals
+	l := NewWithSignalSource(false, &signals)
+	// SIGHUP moves from shutting down to its handler, while the other
+	// shutdown signals are resubscribed
+	l.OnReload(func() {})
+	l.HandleSignal(syscall.SIGUSR2, func(os.Signal) {})
+	l.SetShutdownSignals(DefaultShutdownSignals...)
+	if len(signals.uncovered) > 0 {
+		t.Errorf("%v were briefly unsubscribed while changing shutdown signals", signals.uncovered)
+	}
+
+	signals.Send(syscall.SIGTERM)
+	if s := l.RunUntilKilled(nil, 0); s != ExitClean {
+		t.Errorf("got status %v, expected %v", s, ExitClean)
+	}
+}
+
+type fakeUpgrader struct {
+	err   error
+	calls chan struct{}
+}
+
+func (u *fakeUpgrader) Upgrade(timeout time.Duration) (*os.Process, error) {
+	u.calls <- struct{}{}
+	if u.err != nil {
+		return nil, u.err
+	}
+	return &os.Process{Pid: os.Getpid()}, nil
+}
+
+func TestUpgradeOn(t *testing.T) {
+	var signals ManualSignals
+	l := NewWithSignalSource(false, &signals)
+	failing := &fakeUpgrader{err: errors.New("exec failed"), calls: make(chan struct{}, 1)}
+	l.UpgradeOn(syscall.SIGUSR2, failing, time.Second)
+
+	status := make(chan ExitStatus, 1)
+	go func() { status <- l.RunUntilKilled(nil, 0) }()
+
+	signals.Send(syscall.SIGUSR2)
+	<-failing.calls
+	select {
+	case s := <-status:
+		t.Fatalf("failed upgrade caused shutdown with status %v", s)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	working := &fakeUpgrader{calls: make(chan struct{}, 1)}
+	l.UpgradeOn(syscall.SIGUSR1, working, time.Second)
+	signals.Send(syscall.SIGUSR1)
+	<-working.calls
+	if s := <-status; s != ExitClean {
+		t.Errorf("got status %v, expected %v", s, ExitClean)
+	}
+}
+
+func TestUpgradeEnvClearedWithoutLock(t *testing.T) {
+	os.Setenv(upgradeEnv, "1")
+	defer os.Unsetenv(upgradeEnv)
+	var signals ManualSignals
+	NewWithSignalSource(false, &signals)
+	if _, ok := os.LookupEnv(upgradeEnv); ok {
+		t.Errorf("%s wasn't cleared from the environment", upgradeEnv)
+	}
+}
@@ -0,0 +1,152 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/fastly/go-utils/vlog"
+)
+
+// ErrHookTimeout is recorded for shutdown hooks which were still running when
+// their phase's timeout expired.
+var ErrHookTimeout = errors.New("shutdown hook timed out")
+
+// A HookResult records the outcome of a single shutdown hook.
+type HookResult struct {
+	Phase    string
+	Hook     string
+	Duration time.Duration
+	Err      error
+}
+
+type shutdownHook struct {
+	name string
+	f    func(context.Context) error
+}
+
+type shutdownPhase struct {
+	name    string
+	timeout time.Duration
+	hooks   []shutdownHook
+}
+
+// AddPhase declares a shutdown phase. Phases run one after the other in the
+// order they were declared, after the finalizer passed to RunWhenKilled and
+// before any AddKillFunc functions. If timeout is non-zero, the phase is
+// abandoned once it has run that long; the overall RunWhenKilled timeout
+// still applies. Declaring an existing phase again updates its timeout.
+func (l *Lifecycle) AddPhase(name string, timeout time.Duration) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	l.phase(name).timeout = timeout
+}
+
+// AddShutdownHook registers f to run during the named shutdown phase, which
+// is declared without a timeout if it doesn't already exist. All hooks in a
+// phase run in parallel and are passed a context which expires with the
+// phase. Each hook's duration and error are logged with vlog and kept for
+// ShutdownReport.
+func (l *Lifecycle) AddShutdownHook(phase, name string, f func(ctx context.Context) error) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	p := l.phase(phase)
+	p.hooks = append(p.hooks, shutdownHook{name, f})
+}
+
+// ShutdownReport returns the results of the shutdown hooks which have run so
+// far, in phase order.
+func (l *Lifecycle) ShutdownReport() []HookResult {
+	l.m.Lock()
+	defer l.m.Unlock()
+	return append([]HookResult(nil), l.report...)
+}
+
+// phase returns the named phase, creating it if necessary. l.m must be held.
+func (l *Lifecycle) phase(name string) *shutdownPhase {
+	for _, p := range l.phases {
+		if p.name == name {
+			return p
+		}
+	}
+	p := &shutdownPhase{name: name}
+	l.phases = append(l.phases, p)
+	return p
+}
+
+// snapshotPhases returns a copy of the declared phases which is safe to use
+// without holding l.m.
+func (l *Lifecycle) snapshotPhases() []shutdownPhase {
+	l.m.Lock()
+	defer l.m.Unlock()
+	phases := make([]shutdownPhase, len(l.phases))
+	for i, p := range l.phases {
+		phases[i] = *p
+		phases[i].hooks = append([]shutdownHook(nil), p.hooks...)
+	}
+	return phases
+}
+
+func (l *Lifecycle) runPhases(ctx context.Context, phases []shutdownPhase) {
+	for _, p := range phases {
+		if ctx.Err() != nil {
+			return
+		}
+		l.runPhase(ctx, p)
+	}
+}
+
+func (l *Lifecycle) runPhase(ctx context.Context, p shutdownPhase) {
+	if p.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.timeout)
+		defer cancel()
+	}
+
+	type result struct {
+		i int
+		HookResult
+	}
+	start := time.Now()
+	results := make(chan result, len(p.hooks))
+	for i, h := range p.hooks {
+		go func(i int, h shutdownHook) {
+			hookStart := time.Now()
+			err := h.f(ctx)
+			results <- result{i, HookResult{p.name, h.name, time.Since(hookStart), err}}
+		}(i, h)
+	}
+
+	report := make([]HookResult, len(p.hooks))
+	finished := make([]bool, len(p.hooks))
+	timedOut := false
+	for n := 0; n < len(p.hooks) && !timedOut; n++ {
+		select {
+		case r := <-results:
+			report[r.i] = r.HookResult
+			finished[r.i] = true
+		case <-ctx.Done():
+			timedOut = true
+		}
+	}
+	for i, h := range p.hooks {
+		if !finished[i] {
+			report[i] = HookResult{p.name, h.name, time.Since(start), ErrHookTimeout}
+		}
+	}
+
+	failed := 0
+	for _, r := range report {
+		if r.Err != nil {
+			failed++
+			vlog.VLogf("Shutdown phase %q: hook %q failed after %v: %s", r.Phase, r.Hook, r.Duration, r.Err)
+		} else {
+			vlog.VLogf("Shutdown phase %q: hook %q finished in %v", r.Phase, r.Hook, r.Duration)
+		}
+	}
+	vlog.VLogf("Shutdown phase %q finished in %v (%d hooks, %d failed)", p.name, time.Since(start), len(p.hooks), failed)
+
+	l.m.Lock()
+	l.report = append(l.report, report...)
+	l.m.Unlock()
+}
@@ -0,0 +1,111 @@
+package lifecycle
+
+import (
+	"testing"
+
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+func TestShutdownPhases(t *testing.T) {
+	var signals ManualSignals
+	l := NewWithSignalSource(false, &signals)
+	l.AddPhase("stop accepting", 0)
+	l.AddPhase("drain", time.Second)
+
+	var mu sync.Mutex
+	var order []string
+	record := func(s string) {
+		mu.Lock()
+		defer mu.Unlock()
+		order = append(order, s)
+	}
+
+	// both drain hooks sleep; running them in parallel keeps the phase short
+	for _, name := range []string{"http", "rpc"} {
+		l.AddShutdownHook("drain", name, func(ctx context.Context) error {
+			time.Sleep(50 * time.Millisecond)
+			record("drain")
+			return nil
+		})
+	}
+	l.AddShutdownHook("stop accepting", "listeners", func(ctx context.Context) error {
+		record("stop accepting")
+		return nil
+	})
+	l.AddShutdownHook("close stores", "db", func(ctx context.Context) error {
+		record("close stores")
+		return errors.New("db already closed")
+	})
+	l.AddKillFunc(func() { record("kill func") })
+
+	signals.Send(os.Interrupt)
+	start := time.Now()
+	if status := l.RunUntilKilled(func() { record("finalizer") }, time.Second); status != ExitClean {
+		t.Fatalf("got status %v, expected %v", status, ExitClean)
+	}
+	if elapsed := time.Since(start); elapsed > 90*time.Millisecond {
+		t.Errorf("shutdown took %v; drain hooks didn't run in parallel", elapsed)
+	}
+
+	expected := []string{"finalizer", "stop accepting", "drain", "drain", "close stores", "kill func"}
+	if len(order) != len(expected) {
+		t.Fatalf("got order %v, expected %v", order, expected)
+	}
+	for i := range expected {
+		if order[i] != expected[i] {
+			t.Fatalf("got order %v, expected %v", order, expected)
+		}
+	}
+
+	report := l.ShutdownReport()
+	if len(report) != 4 {
+		t.Fatalf("got %d results, expected 4: %v", len(report), report)
+	}
+	if r := report[1]; r.Phase != "drain" || r.Hook != "http" || r.Err != nil || r.Duration < 50*time.Millisecond {
+		t.Errorf("unexpected drain result %+v", r)
+	}
+	if r := report[3]; r.Phase != "close stores" || r.Err == nil {
+		t.Errorf("expected close stores to report an error, got %+v", r)
+	}
+}
+
+func TestShutdownPhaseTimeout(t *testing.T) {
+	var signals ManualSignals
+	l := NewWithSignalSource(false, &signals)
+	l.AddPhase("flush metrics", 20*time.Millisecond)
+	l.AddShutdownHook("flush metrics", "ganglia", func(ctx context.Context) error {
+		time.Sleep(time.Second)
+		return nil
+	})
+	l.AddShutdownHook("flush metrics", "statsd", func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	ran := false
+	l.AddShutdownHook("close stores", "db", func(ctx context.Context) error {
+		ran = true
+		return nil
+	})
+
+	signals.Send(os.Interrupt)
+	if status := l.RunUntilKilled(nil, time.Second); status != ExitClean {
+		t.Fatalf("got status %v, expected %v", status, ExitClean)
+	}
+	if !ran {
+		t.Errorf("phase after a timed out phase didn't run")
+	}
+	report := l.ShutdownReport()
+	if len(report) != 3 {
+		t.Fatalf("got %d results, expected 3: %v", len(report), report)
+	}
+	if report[0].Err != ErrHookTimeout {
+		t.Errorf("got %v, expected %v", report[0].Err, ErrHookTimeout)
+	}
+	if report[1].Err == nil {
+		t.Errorf("expected an error from the statsd hook")
+	}
+}
@@ -0,0 +1,220 @@
+package lifecycle
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/fastly/go-utils/vlog"
+)
+
+var (
+	// PidDir is the directory in which New creates its lock file when
+	// singleProcess is true. It defaults to $XDG_RUNTIME_DIR, or /run if
+	// that isn't set, falling back to os.TempDir() if neither is writable;
+	// AcquirePidLock refuses files owned by other users, so they can't
+	// interfere there. Deployments of the same binary which should be
+	// allowed to run side by side need different PidDirs.
+	PidDir = defaultPidDir()
+	// PidWait limits how long New waits for another instance to exit when
+	// singleProcess is true. The default of 0 means wait forever.
+	PidWait time.Duration
+
+	pidPollInterval = 100 * time.Millisecond
+	runDir          = "/run"
+)
+
+// A LockedError is returned by AcquirePidLock when another live process holds
+// the lock.
+type LockedError struct {
+	Path string
+	Pid  int // 0 if the holder couldn't be determined
+
+	file os.FileInfo // the locked file, if known
+}
+
+func (e *LockedError) Error() string {
+	if e.Pid == 0 {
+		return fmt.Sprintf("%s is locked by another process", e.Path)
+	}
+	return fmt.Sprintf("%s is locked by pid %d", e.Path, e.Pid)
+}
+
+// A PidLock is an exclusive advisory lock (flock(2)) on a pid file. The lock is
+// released by the kernel if the process dies, so it can't be left behind by
+// a crash.
+type PidLock struct {
+	path string
+	f    *os.File
+}
+
+// AcquirePidLock locks the file at path, creating it if necessary, and writes
+// the current pid into it for the benefit of ops tooling. If another process
+// holds the lock, AcquirePidLock polls until it is released or ctx is done,
+// in which case a *LockedError naming the holder is returned.
+//
+// A lock is considered stale if the pid recorded in the file isn't running,
+// e.g. when a dead daemon's children inherited the locked descriptor. Stale
+// lock files are removed and replaced. Files owned by another user are
+// refused, as are symlinks and anything but regular files.
+func AcquirePidLock(ctx context.Context, path string) (*PidLock, error) {
+	for {
+		l, err := tryPidLock(path)
+		if err == nil {
+			return l, nil
+		}
+		locked, ok := err.(*LockedError)
+		if !ok {
+			return nil, err
+		}
+		if locked.Pid != 0 && !processExists(locked.Pid) {
+			if err := removeStalePidFile(locked); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(pidPollInterval):
+		}
+	}
+}
+
+// removeStalePidFile removes the lock file described by locked, unless it has
+// already been replaced. Removers hold a lock on the directory while they
+// check and remove, so that one which found the same stale file as another
+// can't then remove the fresh file the other put in its place.
+func removeStalePidFile(locked *LockedError) error {
+	dir, err := os.Open(filepath.Dir(locked.Path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	if err := syscall.Flock(int(dir.Fd()), syscall.LOCK_EX); err != nil {
+		return fmt.Errorf("couldn't lock %s: %s", dir.Name(), err)
+	}
+
+	fi, err := os.Lstat(locked.Path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if locked.file == nil || !os.SameFile(fi, locked.file) {
+		// someone else got here first
+		return nil
+	}
+	vlog.VLogf("Removing stale lock file %s held for dead pid %d", locked.Path, locked.Pid)
+	if err := os.Remove(locked.Path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// tryPidLock makes one non-blocking attempt to lock path. It won't follow a
+// symlink at path, open anything but a regular file, or use a file owned by
+// another user, so that it can't be tricked into truncating another file or
+// kept from locking by a planted one.
+func tryPidLock(path string) (*PidLock, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|syscall.O_NOFOLLOW, 0644)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err == nil && !fi.Mode().IsRegular() {
+		err = fmt.Errorf("%s isn't a regular file", path)
+	} else if st, ok := fi.Sys().(*syscall.Stat_t); err == nil && ok && int(st.Uid) != os.Geteuid() {
+		err = fmt.Errorf("%s is owned by uid %d", path, st.Uid)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, &LockedError{Path: path, Pid: readPid(path), file: fi}
+		}
+		return nil, fmt.Errorf("couldn't lock %s: %s", path, err)
+	}
+
+	// the previous holder may have removed the file between our open and
+	// flock, in which case we've locked an orphaned inode
+	var fdStat, pathStat syscall.Stat_t
+	if err := syscall.Fstat(int(f.Fd()), &fdStat); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := syscall.Stat(path, &pathStat); err != nil || fdStat.Ino != pathStat.Ino || fdStat.Dev != pathStat.Dev {
+		f.Close()
+		return nil, &LockedError{Path: path}
+	}
+
+	if err := f.Truncate(0); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := fmt.Fprintf(f, "%d\n", os.Getpid()); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &PidLock{path: path, f: f}, nil
+}
+
+// Path returns the location of the lock file.
+func (l *PidLock) Path() string {
+	if l == nil {
+		return ""
+	}
+	return l.path
+}
+
+// Release removes the lock file and unlocks it.
+func (l *PidLock) Release() error {
+	if l == nil || l.f == nil {
+		return nil
+	}
+	// remove before unlocking so that a waiter can't lock the old inode
+	// after we've let go of it without noticing it was removed
+	err := os.Remove(l.path)
+	if cerr := l.f.Close(); err == nil {
+		err = cerr
+	}
+	l.f = nil
+	return err
+}
+
+func readPid(path string) int {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	pid, _ := strconv.Atoi(strings.TrimSpace(string(b)))
+	return pid
+}
+
+func processExists(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+func defaultPidDir() string {
+	for _, dir := range []string{os.Getenv("XDG_RUNTIME_DIR"), runDir} {
+		if dir != "" && syscall.Access(dir, 2 /* W_OK */) == nil {
+			return dir
+		}
+	}
+	return os.TempDir()
+}
+
+// defaultPidPath is the lock file New uses for the running binary.
+func defaultPidPath() string {
+	return filepath.Join(PidDir, filepath.Base(os.Args[0])+".pid")
+}
@@ -0,0 +1,260 @@
+package lifecycle
+
+import (
+	"testing"
+
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// keep the lock files of tests using New(true) out of /run
+	dir, err := ioutil.TempDir("", "piddir")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	PidDir = dir
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func TestPidLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pidlock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.pid")
+
+	lock, err := AcquirePidLock(context.Background(), path)
+	if err != nil {
+		t.Fatalf("AcquirePidLock: %s", err)
+	}
+	b, _ := ioutil.ReadFile(path)
+	if pid := strings.TrimSpace(string(b)); pid != fmt.Sprint(os.Getpid()) {
+		t.Errorf("pid file contains %q, expected %d", pid, os.Getpid())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = AcquirePidLock(ctx, path)
+	if locked, ok := err.(*LockedError); !ok || locked.Pid != os.Getpid() {
+		t.Errorf("got %v, expected a LockedError for pid %d", err, os.Getpid())
+	}
+
+	if err := lock.Release(); err != nil {
+		t.Errorf("Release: %s", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("pid file still exists after Release")
+	}
+
+	lock, err = AcquirePidLock(context.Background(), path)
+	if err != nil {
+		t.Fatalf("AcquirePidLock after Release: %s", err)
+	}
+	lock.Release()
+}
+
+func TestPidLockWaits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pidlock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.pid")
+
+	first, err := AcquirePidLock(context.Background(), path)
+	if err != nil {
+		t.Fatalf("AcquirePidLock: %s", err)
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		first.Release()
+	}()
+	second, err := AcquirePidLock(context.Background(), path)
+	if err != nil {
+		t.Fatalf("AcquirePidLock while waiting: %s", err)
+	}
+	second.Release()
+}
+
+func TestPidLockStale(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pidlock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.pid")
+
+	// find a pid which isn't running
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Skipf("couldn't run true: %s", err)
+	}
+	dead := cmd.Process.Pid
+
+	// hold the lock as though a child of the dead process inherited it
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(f, "%d\n", dead)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	lock, err := AcquirePidLock(ctx, path)
+	if err != nil {
+		t.Fatalf("AcquirePidLock over stale lock: %s", err)
+	}
+	lock.Release()
+}
+
+func TestPidLockStaleReplaced(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pidlock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.pid")
+
+	// stale lock files are held open by whoever inherited them, so their
+	// inodes can't be reused
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	stale, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// another process removes the stale file and locks a fresh one before
+	// this one gets around to it
+	os.Remove(path)
+	fresh, err := AcquirePidLock(context.Background(), path)
+	if err != nil {
+		t.Fatalf("AcquirePidLock: %s", err)
+	}
+	defer fresh.Release()
+
+	if err := removeStalePidFile(&LockedError{Path: path, Pid: 1, file: stale}); err != nil {
+		t.Fatalf("removeStalePidFile: %s", err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("fresh lock file was removed in place of the stale one: %s", err)
+	}
+}
+
+func TestPidLockRefusesOtherFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pidlock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	target := filepath.Join(dir, "precious")
+	if err := ioutil.WriteFile(target, []byte("keep me\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "link.pid")
+	if err := os.Symlink(target, link); err != nil {
+		t.Fatal(err)
+	}
+	if lock, err := tryPidLock(link); err == nil {
+		lock.Release()
+		t.Errorf("locked through a symlink")
+	}
+	if b, _ := ioutil.ReadFile(target); string(b) != "keep me\n" {
+		t.Errorf("symlink target was overwritten with %q", b)
+	}
+
+	fifo := filepath.Join(dir, "fifo.pid")
+	if err := syscall.Mkfifo(fifo, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if lock, err := tryPidLock(fifo); err == nil {
+		lock.Release()
+		t.Errorf("locked a fifo")
+	}
+}
+
+func TestDefaultPidDir(t *testing.T) {
+	defer func(xdg, run string) {
+		os.Setenv("XDG_RUNTIME_DIR", xdg)
+		runDir = run
+	}(os.Getenv("XDG_RUNTIME_DIR"), runDir)
+
+	dir, err := ioutil.TempDir("", "piddir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Setenv("XDG_RUNTIME_DIR", dir)
+	if got := defaultPidDir(); got != dir {
+		t.Errorf("got %q with XDG_RUNTIME_DIR set, expected %q", got, dir)
+	}
+
+	// a daemon running without XDG_RUNTIME_DIR as a user who can't write
+	// to /run
+	os.Unsetenv("XDG_RUNTIME_DIR")
+	runDir = filepath.Join(dir, "missing")
+	if got := defaultPidDir(); got != os.TempDir() {
+		t.Errorf("got %q when no default was writable, expected %q", got, os.TempDir())
+	}
+}
+
+func TestLockAfterUpgrade(t *testing.T) {
+	// the old process still holds the lock
+	old, err := AcquirePidLock(context.Background(), defaultPidPath())
+	if err != nil {
+		t.Fatalf("AcquirePidLock: %s", err)
+	}
+
+	os.Setenv(upgradeEnv, "1")
+	var signals ManualSignals
+	done := make(chan *Lifecycle, 1)
+	go func() { done <- NewWithSignalSource(true, &signals) }()
+	var l *Lifecycle
+	select {
+	case l = <-done:
+	case <-time.After(time.Second):
+		t.Fatal("New waited for the lock held by the process which started it")
+	}
+	if _, ok := os.LookupEnv(upgradeEnv); ok {
+		t.Errorf("%s wasn't cleared from the environment", upgradeEnv)
+	}
+
+	old.Release()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		l.m.Lock()
+		locked := l.pidLock != nil
+		l.m.Unlock()
+		if locked {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("upgraded process didn't take over the lock")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	signals.Send(os.Interrupt)
+	l.RunUntilKilled(nil, 100*time.Millisecond)
+	if _, err := os.Stat(defaultPidPath()); !os.IsNotExist(err) {
+		t.Errorf("pid file still exists after shutdown")
+	}
+}
@@ -0,0 +1,83 @@
+package lifecycle
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+)
+
+// A SignalSource delivers process signals to a Lifecycle. Its methods have the
+// same semantics as signal.Notify and signal.Stop, which back the default
+// source used by New.
+type SignalSource interface {
+	Notify(c chan<- os.Signal, sig ...os.Signal)
+	Stop(c chan<- os.Signal)
+}
+
+// OSSignals is the SignalSource backed by the os/signal package.
+var OSSignals SignalSource = osSignals{}
+
+type osSignals struct{}
+
+func (osSignals) Notify(c chan<- os.Signal, sig ...os.Signal) { signal.Notify(c, sig...) }
+func (osSignals) Stop(c chan<- os.Signal)                     { signal.Stop(c) }
+
+// ManualSignals is a SignalSource whose signals are only delivered by calling
+// Send. It allows tests to drive a Lifecycle without signalling the test
+// binary itself. The zero value is ready to use.
+type ManualSignals struct {
+	mu    sync.Mutex
+	chans map[chan<- os.Signal][]os.Signal
+}
+
+// Notify registers c to receive sig, or every signal if sig is empty.
+func (m *ManualSignals) Notify(c chan<- os.Signal, sig ...os.Signal) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.chans == nil {
+		m.chans = make(map[chan<- os.Signal][]os.Signal)
+	}
+	if len(sig) == 0 {
+		m.chans[c] = nil
+		return
+	}
+	if s, ok := m.chans[c]; ok && s == nil {
+		return // already receiving everything
+	}
+	m.chans[c] = append(m.chans[c], sig...)
+}
+
+// Stop unregisters c.
+func (m *ManualSignals) Stop(c chan<- os.Signal) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.chans, c)
+}
+
+// Send delivers sig to every channel registered for it. Like os/signal, it
+// does not block: channels which aren't ready to receive miss the signal.
+func (m *ManualSignals) Send(sig os.Signal) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for c, sigs := range m.chans {
+		if !wants(sigs, sig) {
+			continue
+		}
+		select {
+		case c <- sig:
+		default:
+		}
+	}
+}
+
+func wants(sigs []os.Signal, sig os.Signal) bool {
+	if sigs == nil {
+		return true
+	}
+	for _, s := range sigs {
+		if s == sig {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,127 @@
+package lifecycle
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/fastly/go-utils/instrumentation"
+	"github.com/fastly/go-utils/stopper"
+	"github.com/fastly/go-utils/vlog"
+)
+
+const traceSignal = syscall.SIGUSR1
+
+// StackTracerOptions configures InstallStackTracerWithOptions.
+type StackTracerOptions struct {
+	// Signal triggers a dump. The default is SIGUSR1.
+	Signal os.Signal
+	// Dir, if set, is a directory in which each dump is written to its own
+	// timestamped file instead of being logged.
+	Dir string
+	// Keep is the number of dump files to retain in Dir. Older dumps are
+	// removed after each new one is written. 0 keeps every dump.
+	Keep int
+	// Summary dumps goroutines grouped by identical stacks, as returned by
+	// instrumentation.GetStackSummary, instead of the full trace.
+	Summary bool
+	// Signals is the source of Signal. The default is OSSignals.
+	Signals SignalSource
+}
+
+// for debugging, show goroutine trace on receipt of USR1. uninstall by calling
+// Stop on the returned object
+func InstallStackTracer() stopper.Stopper {
+	return InstallStackTracerWithOptions(StackTracerOptions{})
+}
+
+// InstallStackTracerWithOptions is InstallStackTracer with a configurable
+// signal, output destination and format.
+func InstallStackTracerWithOptions(opts StackTracerOptions) stopper.Stopper {
+	if opts.Signal == nil {
+		opts.Signal = traceSignal
+	}
+	if opts.Signals == nil {
+		opts.Signals = OSSignals
+	}
+	signals := make(chan os.Signal, 1)
+	opts.Signals.Notify(signals, opts.Signal)
+	stopper := stopper.NewChanStopper()
+	go func() {
+		defer func() {
+			opts.Signals.Stop(signals)
+			close(signals)
+		}()
+		for {
+			select {
+			case <-signals:
+				dumpStackTrace(opts)
+			case <-stopper.Chan:
+				return
+			}
+		}
+	}()
+	return stopper
+}
+
+func GetStackTrace(all bool) string {
+	return instrumentation.GetStackTrace(all)
+}
+
+func dumpStackTrace(opts StackTracerOptions) {
+	var trace string
+	if opts.Summary {
+		trace = instrumentation.GetStackSummary()
+	} else {
+		trace = instrumentation.GetStackTrace(true)
+	}
+	if opts.Dir == "" {
+		log.Print(trace)
+		return
+	}
+
+	prefix := stackDumpPrefix()
+	name := filepath.Join(opts.Dir, prefix+time.Now().UTC().Format("20060102T150405.000000000Z")+".txt")
+	if err := ioutil.WriteFile(name, []byte(trace), 0644); err != nil {
+		log.Printf("Couldn't write stack trace: %s", err)
+		return
+	}
+	vlog.VLogf("Wrote stack trace to %s", name)
+
+	if opts.Keep > 0 {
+		pruneFiles(opts.Dir, prefix, opts.Keep)
+	}
+}
+
+// stackDumpPrefix is the start of the names of stack dump files.
+func stackDumpPrefix() string {
+	return filepath.Base(os.Args[0]) + "-stacks-"
+}
+
+// pruneFiles removes all but the newest keep files in dir whose names start
+// with prefix and end with a sortable timestamp.
+func pruneFiles(dir, prefix string, keep int) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		log.Printf("Couldn't prune %s: %s", dir, err)
+		return
+	}
+	var names []string
+	for _, info := range infos {
+		if !info.IsDir() && strings.HasPrefix(info.Name(), prefix) {
+			names = append(names, info.Name())
+		}
+	}
+	sort.Strings(names)
+	for len(names) > keep {
+		if err := os.Remove(filepath.Join(dir, names[0])); err != nil {
+			log.Printf("Couldn't remove old dump: %s", err)
+		}
+		names = names[1:]
+	}
+}
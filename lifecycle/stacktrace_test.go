@@ -0,0 +1,66 @@
+package lifecycle
+
+import (
+	"testing"
+
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+func TestStackTracerDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stacks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var signals ManualSignals
+	s := InstallStackTracerWithOptions(StackTracerOptions{
+		Signal:  syscall.SIGUSR2,
+		Dir:     dir,
+		Keep:    2,
+		Summary: true,
+		Signals: &signals,
+	})
+	defer s.Stop()
+
+	// waits until the newest dump is no longer newest
+	waitForDump := func(newest string) []string {
+		deadline := time.Now().Add(time.Second)
+		for time.Now().Before(deadline) {
+			matches, _ := filepath.Glob(filepath.Join(dir, stackDumpPrefix()+"*"))
+			sort.Strings(matches)
+			if len(matches) > 0 && matches[len(matches)-1] != newest {
+				return matches
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		t.Fatalf("no new stack dump appeared")
+		return nil
+	}
+
+	var dumps []string
+	newest := ""
+	for i := 0; i < 3; i++ {
+		signals.Send(syscall.SIGUSR1) // not the configured signal
+		signals.Send(syscall.SIGUSR2)
+		dumps = waitForDump(newest)
+		newest = dumps[len(dumps)-1]
+	}
+	if len(dumps) != 2 {
+		t.Errorf("got %d dumps, expected 2 to be kept: %v", len(dumps), dumps)
+	}
+
+	b, err := ioutil.ReadFile(newest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "InstallStackTracerWithOptions") || !strings.Contains(string(b), " goroutine") {
+		t.Errorf("dump doesn't look like a stack summary:\n%s", b)
+	}
+}
@@ -0,0 +1,75 @@
+package lifecycle
+
+import (
+	"time"
+
+	"github.com/fastly/go-utils/systemd"
+	"github.com/fastly/go-utils/vlog"
+)
+
+// SetStatus publishes a one-line description of what the daemon is doing to
+// systemd, if it is running as a systemd service.
+func (l *Lifecycle) SetStatus(status string) {
+	if _, err := systemd.Status(status); err != nil {
+		vlog.VLogf("Couldn't send status to systemd: %s", err)
+	}
+}
+
+// notifySystemd tells systemd that the daemon has become ready or begun
+// stopping. A process draining after handing over to a new one with
+// UpgradeOn isn't stopping the service, so it says nothing.
+func notifySystemd(s State, upgraded bool) {
+	var state string
+	switch s {
+	case StateReady:
+		state = systemd.Ready
+	case StateDraining:
+		if upgraded {
+			return
+		}
+		state = systemd.Stopping
+	default:
+		return
+	}
+	if _, err := systemd.Notify(state + "\nSTATUS=" + s.String()); err != nil {
+		vlog.VLogf("Couldn't notify systemd that we're %s: %s", s, err)
+	}
+}
+
+// notifySystemdReload brackets the running of OnReload handlers.
+func (l *Lifecycle) notifySystemdReload(starting bool) {
+	state := systemd.Reloading
+	if !starting {
+		if l.State() != StateReady {
+			return
+		}
+		state = systemd.Ready
+	}
+	if _, err := systemd.Notify(state); err != nil {
+		vlog.VLogf("Couldn't notify systemd of reload: %s", err)
+	}
+}
+
+// startWatchdog sends systemd keep-alives at half the watchdog interval until
+// shutdown begins, if the service has WatchdogSec= set.
+func (l *Lifecycle) startWatchdog() {
+	interval := systemd.WatchdogInterval()
+	if interval == 0 {
+		return
+	}
+	vlog.VLogf("Sending systemd watchdog pings every %v", interval/2)
+	go func() {
+		ticker := time.NewTicker(interval / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if _, err := systemd.Notify(systemd.Watchdog); err != nil {
+					vlog.VLogfQuiet("watchdog", "Couldn't ping systemd watchdog: %s", err)
+				}
+			case <-l.ctx.Done():
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,126 @@
+package lifecycle
+
+import (
+	"testing"
+
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+func TestSystemdNotify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "systemd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	os.Setenv("NOTIFY_SOCKET", path)
+	os.Setenv("WATCHDOG_USEC", "20000")
+	os.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	defer func() {
+		os.Unsetenv("NOTIFY_SOCKET")
+		os.Unsetenv("WATCHDOG_USEC")
+		os.Unsetenv("WATCHDOG_PID")
+	}()
+
+	// waits for a notification starting with prefix, skipping watchdog pings
+	// unless that's what we want
+	expect := func(prefix string) {
+		deadline := time.Now().Add(time.Second)
+		for {
+			conn.SetReadDeadline(deadline)
+			b := make([]byte, 1024)
+			n, err := conn.Read(b)
+			if err != nil {
+				t.Fatalf("waiting for %q: %s", prefix, err)
+			}
+			if msg := string(b[:n]); strings.HasPrefix(msg, prefix) {
+				return
+			}
+		}
+	}
+
+	var signals ManualSignals
+	l := NewWithSignalSource(false, &signals)
+	expect("WATCHDOG=1")
+	l.SetReady()
+	expect("READY=1\nSTATUS=ready")
+	l.SetStatus("serving 3 clients")
+	expect("STATUS=serving 3 clients")
+
+	signals.Send(os.Interrupt)
+	l.RunUntilKilled(nil, 0)
+	expect("STOPPING=1")
+}
+
+type recordingUpgrader struct {
+	pid         int
+	watchdogPid string // WATCHDOG_PID while upgrading
+}
+
+func (u *recordingUpgrader) Upgrade(time.Duration) (*os.Process, error) {
+	u.watchdogPid = os.Getenv("WATCHDOG_PID")
+	return os.FindProcess(u.pid)
+}
+
+func TestSystemdNotifyUpgrade(t *testing.T) {
+	dir, err := ioutil.TempDir("", "systemd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	os.Setenv("NOTIFY_SOCKET", path)
+	os.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	defer func() {
+		os.Unsetenv("NOTIFY_SOCKET")
+		os.Unsetenv("WATCHDOG_PID")
+	}()
+
+	var signals ManualSignals
+	l := NewWithSignalSource(false, &signals)
+	u := &recordingUpgrader{pid: 4242}
+	l.UpgradeOn(syscall.SIGUSR2, u, time.Second)
+	l.SetReady()
+	signals.Send(syscall.SIGUSR2)
+	l.RunUntilKilled(nil, 0)
+
+	var msgs []string
+	for {
+		conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		b := make([]byte, 1024)
+		n, err := conn.Read(b)
+		if err != nil {
+			break
+		}
+		msgs = append(msgs, string(b[:n]))
+	}
+	expected := []string{"READY=1\nSTATUS=ready", "MAINPID=4242"}
+	if strings.Join(msgs, "|") != strings.Join(expected, "|") {
+		t.Errorf("got notifications %q during an upgrade, expected %q", msgs, expected)
+	}
+	if u.watchdogPid != "" {
+		t.Errorf("new process was started with WATCHDOG_PID=%s", u.watchdogPid)
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != strconv.Itoa(os.Getpid()) {
+		t.Errorf("WATCHDOG_PID wasn't restored after the upgrade: %q", pid)
+	}
+}
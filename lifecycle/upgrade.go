@@ -0,0 +1,71 @@
+package lifecycle
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/fastly/go-utils/systemd"
+	"github.com/fastly/go-utils/vlog"
+)
+
+// upgradeEnv is set in the environment of processes started by UpgradeOn.
+const upgradeEnv = "__lifecycle_upgrade"
+
+// An Upgrader can hand its resources over to a new copy of the running
+// executable. *server.Server is an Upgrader.
+type Upgrader interface {
+	// Upgrade starts the new process and returns once it is ready to take
+	// over, or with an error if it could not be started within timeout.
+	Upgrade(timeout time.Duration) (*os.Process, error)
+}
+
+// UpgradeOn makes sig trigger a graceful binary upgrade. When sig is received,
+// u is asked to start a new process; once that process is ready, this one
+// shuts down exactly as if a shutdown signal had arrived, so the finalizer,
+// shutdown phases and kill funcs can drain existing work. If the upgrade
+// fails, the error is logged and this process carries on.
+//
+// If this process holds the single-process pid lock, the new one takes it
+// over once this one exits, rather than waiting for it in New.
+//
+// Under systemd, the new process is made the service's main process, and
+// this one doesn't report that the service is stopping, so that systemd
+// keeps the service running once this process exits. The new process sends
+// its own watchdog pings.
+func (l *Lifecycle) UpgradeOn(sig os.Signal, u Upgrader, timeout time.Duration) {
+	l.HandleSignal(sig, func(sig os.Signal) {
+		vlog.VLogf("Caught signal %q, upgrading", sig)
+		proc, err := upgrade(u, timeout)
+		if err != nil {
+			log.Printf("Upgrade failed: %s", err)
+			return
+		}
+		vlog.VLogf("Handed over to new process %d", proc.Pid)
+		l.m.Lock()
+		l.upgraded = true
+		l.m.Unlock()
+		if _, err := systemd.Notify("MAINPID=" + strconv.Itoa(proc.Pid)); err != nil {
+			vlog.VLogf("Couldn't tell systemd that %d is the main process: %s", proc.Pid, err)
+		}
+		select {
+		case l.interrupt <- sig:
+		default:
+			// already shutting down
+		}
+	})
+}
+
+// upgrade runs u.Upgrade with the environment the new process needs: it's
+// told that it was started by UpgradeOn, and WATCHDOG_PID, which names this
+// process, is left out so that the new one finds its own watchdog interval.
+func upgrade(u Upgrader, timeout time.Duration) (*os.Process, error) {
+	os.Setenv(upgradeEnv, "1")
+	defer os.Unsetenv(upgradeEnv)
+	if pid, ok := os.LookupEnv("WATCHDOG_PID"); ok {
+		os.Unsetenv("WATCHDOG_PID")
+		defer os.Setenv("WATCHDOG_PID", pid)
+	}
+	return u.Upgrade(timeout)
+}
@@ -0,0 +1,224 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/fastly/go-utils/vlog"
+)
+
+// connTracker keeps track of the live connections accepted by a Server's
+// listeners.
+type connTracker struct {
+	mu    sync.Mutex
+	conns map[string]map[*trackedConn]struct{}
+	total int
+	idle  chan struct{} // closed when total drops to 0
+}
+
+func newConnTracker() *connTracker {
+	return &connTracker{conns: make(map[string]map[*trackedConn]struct{})}
+}
+
+func (t *connTracker) add(c *trackedConn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conns[c.label] == nil {
+		t.conns[c.label] = make(map[*trackedConn]struct{})
+	}
+	t.conns[c.label][c] = struct{}{}
+	if t.total == 0 {
+		t.idle = make(chan struct{})
+	}
+	t.total++
+}
+
+func (t *connTracker) remove(c *trackedConn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.conns[c.label][c]; !ok {
+		return
+	}
+	delete(t.conns[c.label], c)
+	t.total--
+	if t.total == 0 {
+		close(t.idle)
+	}
+}
+
+// wait returns true once there are no live connections, or false if timeout
+// passes first.
+func (t *connTracker) wait(timeout time.Duration) bool {
+	if t == nil {
+		return true
+	}
+	t.mu.Lock()
+	if t.total == 0 {
+		t.mu.Unlock()
+		return true
+	}
+	idle := t.idle
+	t.mu.Unlock()
+
+	select {
+	case <-idle:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// closeAll closes every live connection and returns how many there were.
+func (t *connTracker) closeAll() int {
+	if t == nil {
+		return 0
+	}
+	t.mu.Lock()
+	var conns []*trackedConn
+	for _, m := range t.conns {
+		for c := range m {
+			conns = append(conns, c)
+		}
+	}
+	t.mu.Unlock()
+	for _, c := range conns {
+		c.Close()
+	}
+	return len(conns)
+}
+
+func (t *connTracker) counts() map[string]int {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	counts := make(map[string]int, len(t.conns))
+	for label, m := range t.conns {
+		counts[label] = len(m)
+	}
+	return counts
+}
+
+// wrappedListener passes File and SetDeadline through to the listener it
+// wraps, so that wrapped listeners can still be handed over by Upgrade and
+// have deadlines set.
+type wrappedListener struct {
+	net.Listener
+}
+
+// Unwrap returns the listener beneath, which may itself be wrapped.
+func (l wrappedListener) Unwrap() net.Listener {
+	return l.Listener
+}
+
+// UnwrapListener returns the listener beneath any wrappers added by the
+// Server, such as the *net.TCPListener or *net.UnixListener it was created
+// with.
+func UnwrapListener(l net.Listener) net.Listener {
+	for {
+		w, ok := l.(interface {
+			Unwrap() net.Listener
+		})
+		if !ok {
+			return l
+		}
+		l = w.Unwrap()
+	}
+}
+
+// File returns a copy of the underlying listener's file.
+func (l wrappedListener) File() (*os.File, error) {
+	if f, ok := l.Listener.(filer); ok {
+		return f.File()
+	}
+	return nil, errors.New("listener has no file")
+}
+
+// SetDeadline sets the deadline of the underlying listener, if it has one.
+func (l wrappedListener) SetDeadline(t time.Time) error {
+	if d, ok := l.Listener.(interface {
+		SetDeadline(time.Time) error
+	}); ok {
+		return d.SetDeadline(t)
+	}
+	return errors.New("listener doesn't support deadlines")
+}
+
+// trackingListener registers each connection it accepts with a connTracker.
+type trackingListener struct {
+	wrappedListener
+	label   string
+	tracker *connTracker
+}
+
+func (l *trackingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	c := &trackedConn{Conn: conn, label: l.label, tracker: l.tracker}
+	l.tracker.add(c)
+	return c, nil
+}
+
+type trackedConn struct {
+	net.Conn
+	label   string
+	tracker *connTracker
+	once    sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() { c.tracker.remove(c) })
+	return c.Conn.Close()
+}
+
+// ConnCount returns the number of connections accepted on label's listener
+// which have not yet been closed. Only listeners with TrackConns set in their
+// ListenerOptions count their connections.
+func (s *Server) ConnCount(label string) int {
+	if s == nil {
+		return 0
+	}
+	return s.conns.counts()[label]
+}
+
+// ConnCounts returns the number of open connections for each label.
+func (s *Server) ConnCounts() map[string]int {
+	if s == nil {
+		return nil
+	}
+	return s.conns.counts()
+}
+
+// Drain stops accepting new connections, waits up to timeout for those which
+// are open to be closed, and then closes any that remain. It returns the
+// number of connections which had to be closed. Only connections accepted by
+// listeners with TrackConns set are waited for.
+func (s *Server) Drain(timeout time.Duration) (forced int) {
+	if s == nil {
+		return 0
+	}
+	s.closeListeners()
+	if timeout > 0 && s.conns.wait(timeout) {
+		return 0
+	}
+	if forced = s.conns.closeAll(); forced > 0 {
+		vlog.VLogf("Closed %d connections still open after draining for %v", forced, timeout)
+	}
+	return forced
+}
+
+// trackListeners wraps the listeners which have TrackConns set in opts, so
+// that their connections are tracked.
+func (s *Server) trackListeners(opts map[string]ListenerOptions) {
+	for label, l := range s.Listeners {
+		if opts[label].TrackConns {
+			s.Listeners[label] = &trackingListener{wrappedListener: wrappedListener{l}, label: label, tracker: s.conns}
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConnTracking(t *testing.T) {
+	addrs := map[string]string{"a": "127.0.0.1:0", "b": "127.0.0.1:0"}
+	s, err := NewServerWithOptions(addrs, trackAll(addrs))
+	if err != nil {
+		t.Fatalf("NewServerWithOptions: %s", err)
+	}
+	accepted := make(chan net.Conn, 10)
+	for _, label := range []string{"a", "b"} {
+		go func(l net.Listener) {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				accepted <- conn
+			}
+		}(s.Listeners[label])
+	}
+
+	var clients []net.Conn
+	for _, label := range []string{"a", "a", "b"} {
+		c, err := net.Dial("tcp", addrs[label])
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		clients = append(clients, c)
+	}
+	var conns []net.Conn
+	for i := 0; i < 3; i++ {
+		conns = append(conns, <-accepted)
+	}
+	if a, b := s.ConnCount("a"), s.ConnCount("b"); a != 2 || b != 1 {
+		t.Errorf("got counts a=%d b=%d, expected a=2 b=1", a, b)
+	}
+
+	// one connection finishes during the drain period, the others don't
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		conns[0].Close()
+	}()
+	start := time.Now()
+	if forced := s.Drain(50 * time.Millisecond); forced != 2 {
+		t.Errorf("Drain force-closed %d connections, expected 2", forced)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("Drain returned after %v, before its timeout", elapsed)
+	}
+	if counts := s.ConnCounts(); counts["a"] != 0 || counts["b"] != 0 {
+		t.Errorf("got counts %v after drain, expected none", counts)
+	}
+
+	// the clients should see their connections closed
+	for _, c := range clients[1:] {
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("expected EOF on force-closed connection, got %v", err)
+		}
+	}
+	if _, err := net.Dial("tcp", addrs["a"]); err == nil {
+		t.Errorf("listener still accepting after Drain")
+	}
+}
+
+func TestDrainIdle(t *testing.T) {
+	addrs := map[string]string{"a": "127.0.0.1:0"}
+	s, err := NewServerWithOptions(addrs, trackAll(addrs))
+	if err != nil {
+		t.Fatalf("NewServerWithOptions: %s", err)
+	}
+	start := time.Now()
+	if forced := s.Drain(time.Second); forced != 0 {
+		t.Errorf("Drain force-closed %d connections, expected 0", forced)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("Drain of an idle server took %v", elapsed)
+	}
+}
+
+// trackAll returns options tracking the connections of each label in addrs.
+func trackAll(addrs map[string]string) map[string]ListenerOptions {
+	opts := make(map[string]ListenerOptions, len(addrs))
+	for label := range addrs {
+		opts[label] = ListenerOptions{TrackConns: true}
+	}
+	return opts
+}
+
+func TestTrackConnsOptIn(t *testing.T) {
+	addrs := map[string]string{"plain": "127.0.0.1:0", "tracked": "127.0.0.1:0"}
+	s, err := NewServerWithOptions(addrs, map[string]ListenerOptions{"tracked": {TrackConns: true}})
+	if err != nil {
+		t.Fatalf("NewServerWithOptions: %s", err)
+	}
+	defer s.closeListeners()
+	if _, ok := s.Listeners["plain"].(*net.TCPListener); !ok {
+		t.Errorf("got %T for an untracked listener, expected *net.TCPListener", s.Listeners["plain"])
+	}
+	if _, ok := s.Listeners["tracked"].(*net.TCPListener); ok {
+		t.Errorf("tracked listener isn't wrapped")
+	}
+	if _, ok := UnwrapListener(s.Listeners["tracked"]).(*net.TCPListener); !ok {
+		t.Errorf("got %T from unwrapping a tracked listener, expected *net.TCPListener", UnwrapListener(s.Listeners["tracked"]))
+	}
+}
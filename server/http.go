@@ -0,0 +1,120 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/fastly/go-utils/vlog"
+)
+
+// ServeHTTPServer runs the server side of the sync points for an HTTP
+// server: it serves hs on the listeners for labels (or on all Listeners if
+// none are given), calls SignalReady once they're being served, and waits
+// for RequestShutdown. It then stops hs with http.Server.Shutdown, giving
+// requests in flight up to DrainTimeout to finish before closing their
+// connections, closes the remaining listeners and calls SignalFinish.
+//
+// If hs.TLSConfig is set, e.g. by the tls package's ConfigureServer, the
+// listeners are served with TLS using its certificates.
+//
+// ServeHTTPServer returns once the server has finished. The error is the
+// first failure to serve a listener, which also causes the server to shut
+// down. If there's nothing to serve, such as a label without a listener,
+// SignalFinish is called straight away, so that WaitForReady and
+// WaitForFinish don't block. A DrainTimeout of zero waits for requests in
+// flight without limit.
+//
+// Since it runs the sync points for the whole Server and closes all of its
+// listeners when done, ServeHTTPServer may only be called once per Server;
+// later calls return an error straight away. Listeners which need serving
+// differently, such as some with TLS and some without, belong in separate
+// Servers.
+func (s *Server) ServeHTTPServer(hs *http.Server, labels ...string) error {
+	if s == nil {
+		return errors.New("ServeHTTPServer needs a Server")
+	}
+	s.initSync()
+	s.mu.Lock()
+	serving := s.servingHTTP
+	s.servingHTTP = true
+	s.mu.Unlock()
+	if serving {
+		return errors.New("ServeHTTPServer has already been called for this Server")
+	}
+
+	listeners, err := s.httpListeners(hs, labels)
+	if err != nil {
+		s.SignalFinish()
+		return err
+	}
+
+	// decided up front, since Serve may itself set hs.TLSConfig
+	useTLS := hs.TLSConfig != nil
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			var err error
+			if useTLS {
+				err = hs.ServeTLS(l, "", "")
+			} else {
+				err = hs.Serve(l)
+			}
+			if err == http.ErrServerClosed {
+				err = nil
+			} else if err != nil {
+				vlog.VLogf("Serving HTTP on %s failed: %s", l.Addr(), err)
+				s.RequestShutdown()
+			}
+			errs <- err
+		}(l)
+	}
+	s.SignalReady()
+
+	<-s.stopping
+	ctx := context.Background()
+	if s.DrainTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.DrainTimeout)
+		defer cancel()
+	}
+	if err := hs.Shutdown(ctx); err != nil {
+		vlog.VLogf("Closing HTTP connections still active after draining for %v", s.DrainTimeout)
+		hs.Close()
+	}
+	s.closeListeners()
+
+	for range listeners {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+		}
+	}
+	s.SignalFinish()
+	return err
+}
+
+// httpListeners returns the listeners ServeHTTPServer should serve hs on.
+func (s *Server) httpListeners(hs *http.Server, labels []string) ([]net.Listener, error) {
+	if hs == nil {
+		return nil, errors.New("ServeHTTPServer needs an http.Server")
+	}
+	var listeners []net.Listener
+	if len(labels) == 0 {
+		for _, l := range s.Listeners {
+			listeners = append(listeners, l)
+		}
+	}
+	for _, label := range labels {
+		l, ok := s.Listeners[label]
+		if !ok {
+			return nil, fmt.Errorf("no stream listener with label %q", label)
+		}
+		listeners = append(listeners, l)
+	}
+	if len(listeners) == 0 {
+		return nil, errors.New("no listeners to serve HTTP on")
+	}
+	return listeners, nil
+}
@@ -0,0 +1,193 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func get(t *testing.T, c *http.Client, url string) string {
+	resp, err := c.Get(url)
+	if err != nil {
+		t.Errorf("GET %s: %s", url, err)
+		return ""
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Errorf("reading %s: %s", url, err)
+	}
+	return string(body)
+}
+
+func TestServeHTTPServer(t *testing.T) {
+	addrs := map[string]string{"a": "127.0.0.1:0", "b": "127.0.0.1:0"}
+	s, err := NewServer(addrs)
+	if err != nil {
+		t.Fatalf("NewServer: %s", err)
+	}
+	s.DrainTimeout = 5 * time.Second
+
+	started := make(chan struct{})
+	hs := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			close(started)
+			time.Sleep(100 * time.Millisecond)
+		}
+		w.Write([]byte("ok"))
+	})}
+	done := make(chan error)
+	go func() { done <- s.ServeHTTPServer(hs) }()
+	s.WaitForReady()
+
+	for _, label := range []string{"a", "b"} {
+		if body := get(t, http.DefaultClient, "http://"+addrs[label]+"/"); body != "ok" {
+			t.Errorf("got %q from %s, expected ok", body, label)
+		}
+	}
+
+	// a request in flight when shutdown is requested completes
+	slow := make(chan string)
+	go func() { slow <- get(t, http.DefaultClient, "http://"+addrs["a"]+"/slow") }()
+	<-started
+	s.Shutdown()
+	if body := <-slow; body != "ok" {
+		t.Errorf("got %q from request in flight during shutdown", body)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("ServeHTTPServer: %s", err)
+	}
+	if _, err := http.Get("http://" + addrs["b"] + "/"); err == nil {
+		t.Errorf("still serving after shutdown")
+	}
+}
+
+func TestServeHTTPServerDrainTimeout(t *testing.T) {
+	addr := "127.0.0.1:0"
+	s, err := NewSingleServer(&addr)
+	if err != nil {
+		t.Fatalf("NewSingleServer: %s", err)
+	}
+	s.DrainTimeout = 50 * time.Millisecond
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	hs := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})}
+	done := make(chan error)
+	go func() { done <- s.ServeHTTPServer(hs, SINGLE) }()
+	s.WaitForReady()
+
+	failed := make(chan error)
+	go func() {
+		_, err := http.Get("http://" + addr + "/")
+		failed <- err
+	}()
+	<-started
+	start := time.Now()
+	s.Shutdown()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("shutdown took %v with a drain timeout of %v", elapsed, s.DrainTimeout)
+	}
+	if err := <-failed; err == nil {
+		t.Errorf("request stuck past the drain timeout succeeded")
+	}
+	<-done
+}
+
+func TestServeHTTPServerTLS(t *testing.T) {
+	// borrow httptest's certificate and a client which trusts it
+	ts := httptest.NewTLSServer(nil)
+	config, client := ts.TLS, ts.Client()
+	ts.Close()
+
+	addr := "127.0.0.1:0"
+	s, err := NewSingleServer(&addr)
+	if err != nil {
+		t.Fatalf("NewSingleServer: %s", err)
+	}
+	hs := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("secure"))
+		}),
+		TLSConfig: config,
+	}
+	done := make(chan error)
+	go func() { done <- s.ServeHTTPServer(hs) }()
+	s.WaitForReady()
+	if body := get(t, client, "https://"+addr+"/"); body != "secure" {
+		t.Errorf("got %q over TLS, expected secure", body)
+	}
+	s.Shutdown()
+	if err := <-done; err != nil {
+		t.Errorf("ServeHTTPServer: %s", err)
+	}
+}
+
+func TestServeHTTPServerUnknownLabel(t *testing.T) {
+	addr := "127.0.0.1:0"
+	s, err := NewSingleServer(&addr)
+	if err != nil {
+		t.Fatalf("NewSingleServer: %s", err)
+	}
+	defer s.closeListeners()
+	if err := s.ServeHTTPServer(&http.Server{}, "missing"); err == nil {
+		t.Errorf("ServeHTTPServer succeeded with an unknown label")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.WaitForReadyContext(ctx); err != ErrFinished {
+		t.Errorf("WaitForReady after a failure to serve: got %v, expected %v", err, ErrFinished)
+	}
+	if err := s.WaitForFinishContext(ctx); err != nil {
+		t.Errorf("WaitForFinish after a failure to serve: %s", err)
+	}
+}
+
+func TestServeHTTPServerNoListeners(t *testing.T) {
+	s := &Server{Listeners: map[string]net.Listener{}}
+	if err := s.ServeHTTPServer(&http.Server{}); err == nil {
+		t.Errorf("ServeHTTPServer succeeded without listeners")
+	}
+	select {
+	case <-s.Done():
+	case <-time.After(time.Second):
+		t.Errorf("server didn't finish after failing to serve")
+	}
+}
+
+func TestServeHTTPServerTwice(t *testing.T) {
+	addrs := map[string]string{"plain": "127.0.0.1:0", "other": "127.0.0.1:0"}
+	s, err := NewServer(addrs)
+	if err != nil {
+		t.Fatalf("NewServer: %s", err)
+	}
+	hs := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})}
+	done := make(chan error)
+	go func() { done <- s.ServeHTTPServer(hs, "plain") }()
+	s.WaitForReady()
+
+	if err := s.ServeHTTPServer(&http.Server{}, "other"); err == nil {
+		t.Errorf("second call to ServeHTTPServer succeeded")
+	}
+	if s.State() != StateReady {
+		t.Errorf("server is %v after a second call to ServeHTTPServer, expected %v", s.State(), StateReady)
+	}
+	if body := get(t, http.DefaultClient, "http://"+addrs["plain"]+"/"); body != "ok" {
+		t.Errorf("got %q, expected ok", body)
+	}
+
+	s.Shutdown()
+	if err := <-done; err != nil {
+		t.Errorf("ServeHTTPServer: %s", err)
+	}
+}
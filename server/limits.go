@@ -0,0 +1,304 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fastly/go-utils/vlog"
+)
+
+// ConnLimits restricts the connections accepted by a listener. Zero fields
+// impose no limit.
+type ConnLimits struct {
+	// MaxConns is the most connections which may be open at once.
+	MaxConns int
+	// Rate is the average number of connections accepted per second, with
+	// bursts of up to Burst connections. Burst defaults to 1.
+	Rate  float64
+	Burst int
+	// MaxConnsPerIP is the most connections which may be open at once from
+	// any one source address. It doesn't apply to unix domain sockets.
+	MaxConnsPerIP int
+	// Wait, if true, holds connections over MaxConns or Rate in the
+	// listen backlog until they can be accepted, rather than accepting and
+	// immediately closing them. Connections over MaxConnsPerIP are always
+	// closed, since their source isn't known until they're accepted.
+	Wait bool
+	// OnReject, if set, is called with the label of the listener and the
+	// reason each time a connection is closed for exceeding a limit.
+	OnReject func(label string, reason RejectReason, remote net.Addr)
+}
+
+func (c ConnLimits) enabled() bool {
+	return c.MaxConns > 0 || c.Rate > 0 || c.MaxConnsPerIP > 0
+}
+
+// RejectReason is the limit a rejected connection exceeded.
+type RejectReason int
+
+const (
+	RejectMaxConns RejectReason = iota
+	RejectRate
+	RejectPerIP
+)
+
+func (r RejectReason) String() string {
+	switch r {
+	case RejectMaxConns:
+		return "max_conns"
+	case RejectRate:
+		return "rate"
+	case RejectPerIP:
+		return "per_ip"
+	}
+	return fmt.Sprintf("RejectReason(%d)", int(r))
+}
+
+// RejectCounts is the number of connections a listener has closed for
+// exceeding each of its limits.
+type RejectCounts struct {
+	MaxConns, Rate, PerIP uint64
+}
+
+// Total returns the number of connections rejected for any reason.
+func (c RejectCounts) Total() uint64 {
+	return c.MaxConns + c.Rate + c.PerIP
+}
+
+// tokenBucket allows rate events per second on average, in bursts of up to
+// burst.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// reserve takes a token, and returns how long to wait before the event it's
+// taken for may happen. If wait is false, it only takes a token which is
+// available now.
+func (b *tokenBucket) reserve(now time.Time, wait bool) (delay time.Duration, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(b.burst, b.tokens+elapsed.Seconds()*b.rate)
+		b.last = now
+	}
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0, true
+	}
+	if !wait {
+		return 0, false
+	}
+	b.tokens--
+	return time.Duration((-b.tokens) / b.rate * float64(time.Second)), true
+}
+
+// limitedListener enforces ConnLimits on the connections it accepts.
+type limitedListener struct {
+	wrappedListener
+	label  string
+	limits ConnLimits
+	slots  chan struct{} // one per open connection, if MaxConns is set
+	bucket *tokenBucket
+
+	mu    sync.Mutex
+	perIP map[string]int
+
+	rejected  [3]uint64 // indexed by RejectReason
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newLimitedListener(l net.Listener, label string, limits ConnLimits) *limitedListener {
+	ll := &limitedListener{
+		wrappedListener: wrappedListener{l},
+		label:           label,
+		limits:          limits,
+		perIP:           make(map[string]int),
+		closed:          make(chan struct{}),
+	}
+	if limits.MaxConns > 0 {
+		ll.slots = make(chan struct{}, limits.MaxConns)
+	}
+	if limits.Rate > 0 {
+		ll.bucket = newTokenBucket(limits.Rate, limits.Burst)
+	}
+	return ll
+}
+
+func (l *limitedListener) Accept() (net.Conn, error) {
+	for {
+		if l.limits.Wait {
+			if err := l.waitForSlot(); err != nil {
+				return nil, err
+			}
+		}
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			if l.limits.Wait {
+				l.releaseSlot()
+			}
+			return nil, err
+		}
+		c, reason, ok := l.admit(conn)
+		if ok {
+			return c, nil
+		}
+		l.reject(conn, reason)
+	}
+}
+
+// waitForSlot blocks until the MaxConns and Rate limits allow another
+// connection to be accepted.
+func (l *limitedListener) waitForSlot() error {
+	if l.slots != nil {
+		select {
+		case l.slots <- struct{}{}:
+		case <-l.closed:
+			return &net.OpError{Op: "accept", Net: l.Addr().Network(), Addr: l.Addr(), Err: net.ErrClosed}
+		}
+	}
+	if l.bucket != nil {
+		if delay, _ := l.bucket.reserve(time.Now(), true); delay > 0 {
+			select {
+			case <-time.After(delay):
+			case <-l.closed:
+				l.releaseSlot()
+				return &net.OpError{Op: "accept", Net: l.Addr().Network(), Addr: l.Addr(), Err: net.ErrClosed}
+			}
+		}
+	}
+	return nil
+}
+
+// admit checks conn against the limits which weren't waited for.
+func (l *limitedListener) admit(conn net.Conn) (c net.Conn, reason RejectReason, ok bool) {
+	if !l.limits.Wait {
+		if l.slots != nil {
+			select {
+			case l.slots <- struct{}{}:
+			default:
+				return nil, RejectMaxConns, false
+			}
+		}
+		if l.bucket != nil {
+			if _, ok := l.bucket.reserve(time.Now(), false); !ok {
+				l.releaseSlot()
+				return nil, RejectRate, false
+			}
+		}
+	}
+	ip := remoteIP(conn.RemoteAddr())
+	if l.limits.MaxConnsPerIP > 0 && ip != "" {
+		l.mu.Lock()
+		if l.perIP[ip] >= l.limits.MaxConnsPerIP {
+			l.mu.Unlock()
+			l.releaseSlot()
+			return nil, RejectPerIP, false
+		}
+		l.perIP[ip]++
+		l.mu.Unlock()
+	} else {
+		ip = ""
+	}
+	return &limitedConn{Conn: conn, listener: l, ip: ip}, 0, true
+}
+
+func (l *limitedListener) reject(conn net.Conn, reason RejectReason) {
+	atomic.AddUint64(&l.rejected[reason], 1)
+	vlog.VLogfQuiet("reject:"+l.label, "Rejected connection from %s on %q: over %s limit", conn.RemoteAddr(), l.label, reason)
+	if l.limits.OnReject != nil {
+		l.limits.OnReject(l.label, reason, conn.RemoteAddr())
+	}
+	conn.Close()
+}
+
+func (l *limitedListener) releaseSlot() {
+	if l.slots != nil {
+		<-l.slots
+	}
+}
+
+func (l *limitedListener) release(ip string) {
+	if ip != "" {
+		l.mu.Lock()
+		if l.perIP[ip]--; l.perIP[ip] <= 0 {
+			delete(l.perIP, ip)
+		}
+		l.mu.Unlock()
+	}
+	l.releaseSlot()
+}
+
+func (l *limitedListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return l.Listener.Close()
+}
+
+func (l *limitedListener) rejections() RejectCounts {
+	return RejectCounts{
+		MaxConns: atomic.LoadUint64(&l.rejected[RejectMaxConns]),
+		Rate:     atomic.LoadUint64(&l.rejected[RejectRate]),
+		PerIP:    atomic.LoadUint64(&l.rejected[RejectPerIP]),
+	}
+}
+
+func remoteIP(addr net.Addr) string {
+	if a, ok := addr.(*net.TCPAddr); ok {
+		return a.IP.String()
+	}
+	return ""
+}
+
+type limitedConn struct {
+	net.Conn
+	listener *limitedListener
+	ip       string
+	once     sync.Once
+}
+
+func (c *limitedConn) Close() error {
+	c.once.Do(func() { c.listener.release(c.ip) })
+	return c.Conn.Close()
+}
+
+// Rejections returns the number of connections each listener with
+// ConnLimits has rejected, by label.
+func (s *Server) Rejections() map[string]RejectCounts {
+	if s == nil {
+		return nil
+	}
+	counts := make(map[string]RejectCounts, len(s.limiters))
+	for label, l := range s.limiters {
+		counts[label] = l.rejections()
+	}
+	return counts
+}
+
+// limitListeners wraps the listeners which have limits in opts.
+func (s *Server) limitListeners(opts map[string]ListenerOptions) {
+	for label, l := range s.Listeners {
+		if limits := opts[label].Limits; limits.enabled() {
+			ll := newLimitedListener(l, label, limits)
+			if s.limiters == nil {
+				s.limiters = make(map[string]*limitedListener)
+			}
+			s.limiters[label] = ll
+			s.Listeners[label] = ll
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// limitedServer returns a Server with one listener limited by limits, and a
+// channel of the connections it accepts.
+func limitedServer(t *testing.T, limits ConnLimits) (*Server, string, chan net.Conn) {
+	addrs := map[string]string{"a": "127.0.0.1:0"}
+	s, err := NewServerWithOptions(addrs, map[string]ListenerOptions{"a": {Limits: limits}})
+	if err != nil {
+		t.Fatalf("NewServerWithOptions: %s", err)
+	}
+	accepted := make(chan net.Conn, 10)
+	go func() {
+		for {
+			conn, err := s.Listeners["a"].Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+	return s, addrs["a"], accepted
+}
+
+func dial(t *testing.T, addr string) net.Conn {
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// rejected returns true if the server closes c without writing to it.
+func rejected(c net.Conn) bool {
+	c.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err := c.Read(make([]byte, 1))
+	return err == io.EOF
+}
+
+func TestMaxConns(t *testing.T) {
+	var mu sync.Mutex
+	var reasons []RejectReason
+	s, addr, accepted := limitedServer(t, ConnLimits{
+		MaxConns: 2,
+		OnReject: func(label string, reason RejectReason, remote net.Addr) {
+			mu.Lock()
+			defer mu.Unlock()
+			reasons = append(reasons, reason)
+		},
+	})
+	defer s.closeListeners()
+
+	c1, c2 := dial(t, addr), dial(t, addr)
+	defer c1.Close()
+	defer c2.Close()
+	conn := <-accepted
+	<-accepted
+	c3 := dial(t, addr)
+	defer c3.Close()
+	if !rejected(c3) {
+		t.Errorf("connection over MaxConns wasn't closed")
+	}
+
+	// closing a connection frees its slot
+	conn.Close()
+	c4 := dial(t, addr)
+	defer c4.Close()
+	select {
+	case <-accepted:
+	case <-time.After(time.Second):
+		t.Errorf("connection not accepted after a slot was freed")
+	}
+
+	if counts := s.Rejections()["a"]; counts.MaxConns != 1 || counts.Total() != 1 {
+		t.Errorf("got rejection counts %+v, expected 1 over MaxConns", counts)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(reasons) != 1 || reasons[0] != RejectMaxConns {
+		t.Errorf("OnReject called with %v, expected [%v]", reasons, RejectMaxConns)
+	}
+}
+
+func TestMaxConnsWait(t *testing.T) {
+	s, addr, accepted := limitedServer(t, ConnLimits{MaxConns: 1, Wait: true})
+
+	c1 := dial(t, addr)
+	defer c1.Close()
+	conn := <-accepted
+	c2 := dial(t, addr)
+	defer c2.Close()
+	select {
+	case <-accepted:
+		t.Fatalf("connection over MaxConns accepted")
+	case <-time.After(50 * time.Millisecond):
+	}
+	conn.Close()
+	select {
+	case <-accepted:
+	case <-time.After(time.Second):
+		t.Errorf("held connection not accepted after a slot was freed")
+	}
+	if counts := s.Rejections()["a"]; counts.Total() != 0 {
+		t.Errorf("got rejection counts %+v while waiting", counts)
+	}
+
+	// closing the listener must interrupt an Accept waiting for a slot
+	s.closeListeners()
+}
+
+func TestAcceptRate(t *testing.T) {
+	s, addr, accepted := limitedServer(t, ConnLimits{Rate: 10, Burst: 2})
+	defer s.closeListeners()
+
+	for i := 0; i < 2; i++ {
+		c := dial(t, addr)
+		defer c.Close()
+		<-accepted
+	}
+	c := dial(t, addr)
+	defer c.Close()
+	if !rejected(c) {
+		t.Errorf("connection over the burst wasn't closed")
+	}
+	time.Sleep(150 * time.Millisecond)
+	c = dial(t, addr)
+	defer c.Close()
+	select {
+	case <-accepted:
+	case <-time.After(time.Second):
+		t.Errorf("connection not accepted after the bucket refilled")
+	}
+	if counts := s.Rejections()["a"]; counts.Rate != 1 {
+		t.Errorf("got rejection counts %+v, expected 1 over Rate", counts)
+	}
+}
+
+func TestMaxConnsPerIP(t *testing.T) {
+	s, addr, accepted := limitedServer(t, ConnLimits{MaxConnsPerIP: 1})
+	defer s.closeListeners()
+
+	c1 := dial(t, addr)
+	defer c1.Close()
+	conn := <-accepted
+	c2 := dial(t, addr)
+	defer c2.Close()
+	if !rejected(c2) {
+		t.Errorf("second connection from one IP wasn't closed")
+	}
+	conn.Close()
+	c3 := dial(t, addr)
+	defer c3.Close()
+	select {
+	case <-accepted:
+	case <-time.After(time.Second):
+		t.Errorf("connection not accepted after the first from its IP closed")
+	}
+	if counts := s.Rejections()["a"]; counts.PerIP != 1 {
+		t.Errorf("got rejection counts %+v, expected 1 over MaxConnsPerIP", counts)
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	b := newTokenBucket(2, 1)
+	start := b.last
+	if _, ok := b.reserve(start, false); !ok {
+		t.Errorf("first token unavailable")
+	}
+	if _, ok := b.reserve(start, false); ok {
+		t.Errorf("token available beyond the burst")
+	}
+	if delay, _ := b.reserve(start, true); delay != 500*time.Millisecond {
+		t.Errorf("got delay %v for a reserved token, expected 500ms", delay)
+	}
+	if _, ok := b.reserve(start.Add(time.Second), false); !ok {
+		t.Errorf("token unavailable after refilling")
+	}
+}
+
+func TestLimitedListenerClosedWhileWaiting(t *testing.T) {
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := newLimitedListener(raw, "a", ConnLimits{MaxConns: 1, Wait: true})
+	l.slots <- struct{}{} // the only slot is taken
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := l.Accept()
+		errs <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	l.Close()
+	select {
+	case err := <-errs:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Errorf("got %v from Accept after Close, expected net.ErrClosed", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Accept still waiting for a slot after Close")
+	}
+}
@@ -0,0 +1,218 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/fastly/go-utils/vlog"
+)
+
+// ListenerOptions configures how the listener for a label is created.
+type ListenerOptions struct {
+	// Mode, if non-zero, is applied to unix domain sockets after binding.
+	Mode os.FileMode
+	// Owner and Group, if set, are the user and group (by name or numeric
+	// id) given ownership of unix domain sockets after binding.
+	Owner, Group string
+	// Limits restricts the connections accepted on stream listeners.
+	Limits ConnLimits
+	// TrackConns makes stream listeners track the connections they accept,
+	// so that they're counted by ConnCount and drained by Drain. The
+	// listener is then wrapped, and its connections too; Unwrap reaches the
+	// listener beneath.
+	TrackConns bool
+	// Proxy, if set, makes stream listeners parse PROXY protocol headers.
+	// Limits are applied before the header is read, so MaxConnsPerIP counts
+	// connections from the proxy rather than from the client it names.
+	Proxy *ProxyProtocol
+}
+
+// networks which may prefix an address
+var networks = map[string]bool{
+	"tcp": true, "tcp4": true, "tcp6": true,
+	"udp": true, "udp4": true, "udp6": true,
+	"unix": true, "unixpacket": true, "unixgram": true,
+}
+
+// parseAddr splits an address of the form [network:]address. Addresses
+// without a recognized network prefix are tcp.
+func parseAddr(addr string) (network, address string, prefixed bool) {
+	if i := strings.Index(addr, ":"); i >= 0 && networks[addr[:i]] {
+		return addr[:i], addr[i+1:], true
+	}
+	return "tcp", addr, false
+}
+
+func isPacketNetwork(network string) bool {
+	switch network {
+	case "udp", "udp4", "udp6", "unixgram":
+		return true
+	}
+	return false
+}
+
+func isUnixNetwork(network string) bool {
+	return strings.HasPrefix(network, "unix")
+}
+
+// a socket is either a stream listener or a packet connection.
+type socket struct {
+	listener net.Listener
+	packet   net.PacketConn
+}
+
+func (s socket) addr() net.Addr {
+	if s.packet != nil {
+		return s.packet.LocalAddr()
+	}
+	return s.listener.Addr()
+}
+
+func (s socket) close() error {
+	if s.packet != nil {
+		return s.packet.Close()
+	}
+	return s.listener.Close()
+}
+
+// fileSocket returns a listener or packet connection for a socket inherited
+// from another process.
+func fileSocket(f *os.File) (socket, error) {
+	listener, err := net.FileListener(f)
+	if err == nil {
+		return socket{listener: listener}, nil
+	}
+	packet, perr := net.FilePacketConn(f)
+	if perr == nil {
+		return socket{packet: packet}, nil
+	}
+	return socket{}, err
+}
+
+// listen binds addr, which may carry a network prefix as understood by
+// parseAddr. bound is the address actually bound, with the same prefix.
+func listen(addr string, opts ListenerOptions) (sock socket, bound string, err error) {
+	network, address, prefixed := parseAddr(addr)
+	unixFile := isUnixNetwork(network) && !strings.HasPrefix(address, "@")
+	if unixFile {
+		if err = removeStaleSocket(network, address); err != nil {
+			return
+		}
+	}
+
+	if isPacketNetwork(network) {
+		sock.packet, err = net.ListenPacket(network, address)
+	} else {
+		sock.listener, err = net.Listen(network, address)
+	}
+	if err != nil {
+		return
+	}
+
+	if unixFile {
+		if err = setSocketOwnership(address, opts); err != nil {
+			sock.close()
+			return socket{}, "", err
+		}
+	}
+
+	bound = sock.addr().String()
+	if prefixed {
+		bound = network + ":" + bound
+	}
+	return
+}
+
+// removeStaleSocket removes a unix socket at path left behind by a process
+// which is no longer listening on it.
+func removeStaleSocket(network, path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and isn't a socket", path)
+	}
+	conn, err := net.DialTimeout(network, path, time.Second)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use by another process", path)
+	}
+	if !isConnRefused(err) {
+		return fmt.Errorf("couldn't tell if %s is in use: %s", path, err)
+	}
+	vlog.VLogf("Removing stale socket %s", path)
+	return os.Remove(path)
+}
+
+func isConnRefused(err error) bool {
+	if op, ok := err.(*net.OpError); ok {
+		err = op.Err
+	}
+	if sys, ok := err.(*os.SyscallError); ok {
+		err = sys.Err
+	}
+	return err == syscall.ECONNREFUSED
+}
+
+// setSocketOwnership applies opts' mode and ownership to the socket at path.
+func setSocketOwnership(path string, opts ListenerOptions) error {
+	if opts.Owner != "" || opts.Group != "" {
+		uid, gid := -1, -1
+		if opts.Owner != "" {
+			id, err := lookupID(opts.Owner, func(name string) (string, error) {
+				u, err := user.Lookup(name)
+				if err != nil {
+					return "", err
+				}
+				return u.Uid, nil
+			})
+			if err != nil {
+				return fmt.Errorf("unknown owner %q for %s: %s", opts.Owner, path, err)
+			}
+			uid = id
+		}
+		if opts.Group != "" {
+			id, err := lookupID(opts.Group, func(name string) (string, error) {
+				g, err := user.LookupGroup(name)
+				if err != nil {
+					return "", err
+				}
+				return g.Gid, nil
+			})
+			if err != nil {
+				return fmt.Errorf("unknown group %q for %s: %s", opts.Group, path, err)
+			}
+			gid = id
+		}
+		if err := os.Chown(path, uid, gid); err != nil {
+			return err
+		}
+	}
+	if opts.Mode != 0 {
+		if err := os.Chmod(path, opts.Mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lookupID returns name if it's numeric, or else the id lookup finds for it.
+func lookupID(name string, lookup func(string) (string, error)) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+	id, err := lookup(name)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(id)
+}
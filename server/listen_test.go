@@ -0,0 +1,129 @@
+package server
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseAddr(t *testing.T) {
+	for _, c := range []struct {
+		addr, network, address string
+		prefixed               bool
+	}{
+		{"127.0.0.1:80", "tcp", "127.0.0.1:80", false},
+		{"localhost:80", "tcp", "localhost:80", false},
+		{":80", "tcp", ":80", false},
+		{"tcp6:[::1]:0", "tcp6", "[::1]:0", true},
+		{"udp::514", "udp", ":514", true},
+		{"unix:/run/foo.sock", "unix", "/run/foo.sock", true},
+		{"unixpacket:@abstract", "unixpacket", "@abstract", true},
+	} {
+		network, address, prefixed := parseAddr(c.addr)
+		if network != c.network || address != c.address || prefixed != c.prefixed {
+			t.Errorf("parseAddr(%q) = %q, %q, %v; expected %q, %q, %v",
+				c.addr, network, address, prefixed, c.network, c.address, c.prefixed)
+		}
+	}
+}
+
+func TestUnixListener(t *testing.T) {
+	dir, err := ioutil.TempDir("", "server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.sock")
+
+	// leave a stale socket behind
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+
+	addrs := map[string]string{"sock": "unix:" + path, "tcp": "127.0.0.1:0"}
+	opts := map[string]ListenerOptions{"sock": {Mode: 0600, Owner: "root"}}
+	if os.Getuid() != 0 {
+		opts["sock"] = ListenerOptions{Mode: 0600}
+	}
+	s, err := NewServerWithOptions(addrs, opts)
+	if err != nil {
+		t.Fatalf("NewServerWithOptions: %s", err)
+	}
+	defer s.closeListeners()
+
+	if addrs["sock"] != "unix:"+path {
+		t.Errorf("got address %q, expected %q", addrs["sock"], "unix:"+path)
+	}
+	if strings.HasPrefix(addrs["tcp"], "tcp:") || strings.HasSuffix(addrs["tcp"], ":0") {
+		t.Errorf("got unexpected tcp address %q", addrs["tcp"])
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := fi.Mode().Perm(); mode != 0600 {
+		t.Errorf("got socket mode %v, expected %v", mode, os.FileMode(0600))
+	}
+
+	go func() {
+		if conn, err := s.Listeners["sock"].Accept(); err == nil {
+			conn.Close()
+		}
+	}()
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("Dial: %s", err)
+	}
+	conn.Close()
+
+	// a live socket must not be removed
+	if _, err := NewServer(map[string]string{"sock": "unix:" + path}); err == nil {
+		t.Errorf("bound a unix socket which is already in use")
+	}
+}
+
+func TestPacketListener(t *testing.T) {
+	addrs := map[string]string{"syslog": "udp:127.0.0.1:0"}
+	s, err := NewServer(addrs)
+	if err != nil {
+		t.Fatalf("NewServer: %s", err)
+	}
+	defer s.closeListeners()
+	if len(s.Listeners) != 0 || s.PacketConns["syslog"] == nil {
+		t.Fatalf("expected a packet conn, got Listeners=%v PacketConns=%v", s.Listeners, s.PacketConns)
+	}
+	network, address, _ := parseAddr(addrs["syslog"])
+	if network != "udp" || strings.HasSuffix(address, ":0") {
+		t.Fatalf("got unexpected bound address %q", addrs["syslog"])
+	}
+
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("hello"))
+	b := make([]byte, 16)
+	n, _, err := s.PacketConns["syslog"].ReadFrom(b)
+	if err != nil || string(b[:n]) != "hello" {
+		t.Errorf("got %q, %v; expected %q", b[:n], err, "hello")
+	}
+}
+
+func TestTCP6Listener(t *testing.T) {
+	addrs := map[string]string{"v6": "tcp6:[::1]:0"}
+	s, err := NewServer(addrs)
+	if err != nil {
+		t.Skipf("no IPv6 loopback: %s", err)
+	}
+	defer s.closeListeners()
+	if !strings.HasPrefix(addrs["v6"], "tcp6:[::1]:") || strings.HasSuffix(addrs["v6"], ":0") {
+		t.Errorf("got unexpected bound address %q", addrs["v6"])
+	}
+}
@@ -0,0 +1,381 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fastly/go-utils/vlog"
+)
+
+// ProxyProtocol enables parsing of the PROXY protocol headers, version 1 or
+// 2, which load balancers such as HAProxy prepend to proxied connections.
+// RemoteAddr and LocalAddr of accepted connections then report the addresses
+// of the original connection given in the header.
+//
+// Headers are read in the background as connections arrive, so Accept
+// returns a connection only once its header has been read, and a slow client
+// doesn't hold up the others. RemoteAddr and LocalAddr never block.
+// Connections whose header is missing or malformed fail to Read. A LOCAL or
+// UNKNOWN header, as sent by health checks, leaves the addresses as they
+// are.
+type ProxyProtocol struct {
+	// Trusted lists the networks which are allowed to send PROXY headers.
+	// Connections from any other source are used as they are, without
+	// looking for a header. If Trusted is empty, no source is trusted.
+	// Connections to unix sockets are trusted as long as any network is.
+	Trusted []*net.IPNet
+	// Timeout limits how long reading the header may take. The default is
+	// DefaultProxyTimeout.
+	Timeout time.Duration
+}
+
+// DefaultProxyTimeout is the default ProxyProtocol.Timeout.
+var DefaultProxyTimeout = 5 * time.Second
+
+// maxPendingProxyConns limits how many connections a proxyListener reads
+// headers from at once, before they're returned by Accept.
+const maxPendingProxyConns = 128
+
+// ParseCIDRs parses a list of CIDR networks such as "10.0.0.0/8", for use
+// as ProxyProtocol.Trusted.
+func ParseCIDRs(cidrs ...string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func (p *ProxyProtocol) trusts(addr net.Addr) bool {
+	if len(p.Trusted) == 0 {
+		return false
+	}
+	a, ok := addr.(*net.TCPAddr)
+	if !ok {
+		// unix domain sockets are only reachable locally
+		return true
+	}
+	for _, n := range p.Trusted {
+		if n.Contains(a.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyListener reads the PROXY headers of the connections it accepts from
+// trusted sources before returning them from Accept.
+type proxyListener struct {
+	wrappedListener
+	proxy *ProxyProtocol
+
+	start   sync.Once
+	conns   chan net.Conn // connections ready to be returned by Accept
+	errs    chan error    // errors from the underlying Accept
+	pending chan struct{} // one per connection not yet returned by Accept
+
+	closeOnce sync.Once
+	closed    chan struct{} // closed by Close
+	done      chan struct{} // closed when acceptLoop returns
+}
+
+func newProxyListener(l net.Listener, p *ProxyProtocol) *proxyListener {
+	return &proxyListener{
+		wrappedListener: wrappedListener{l},
+		proxy:           p,
+		conns:           make(chan net.Conn),
+		errs:            make(chan error),
+		pending:         make(chan struct{}, maxPendingProxyConns),
+		closed:          make(chan struct{}),
+		done:            make(chan struct{}),
+	}
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	l.start.Do(func() { go l.acceptLoop() })
+	select {
+	case conn := <-l.conns:
+		<-l.pending
+		return conn, nil
+	case err := <-l.errs:
+		return nil, err
+	case <-l.done:
+		return nil, &net.OpError{Op: "accept", Net: l.Addr().Network(), Addr: l.Addr(), Err: net.ErrClosed}
+	}
+}
+
+// acceptLoop accepts connections from the underlying listener and hands
+// them to Accept, reading headers first where they're expected. Errors are
+// passed on one per call to Accept.
+func (l *proxyListener) acceptLoop() {
+	defer close(l.done)
+	timeout := l.proxy.Timeout
+	if timeout <= 0 {
+		timeout = DefaultProxyTimeout
+	}
+	for {
+		select {
+		case l.pending <- struct{}{}:
+		case <-l.closed:
+			return
+		}
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			<-l.pending
+			select {
+			case l.errs <- err:
+			case <-l.closed:
+				return
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		go func() {
+			if l.proxy.trusts(conn.RemoteAddr()) {
+				conn = newProxyConn(conn, timeout)
+			}
+			select {
+			case l.conns <- conn:
+			case <-l.closed:
+				conn.Close()
+			}
+		}()
+	}
+}
+
+func (l *proxyListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return l.Listener.Close()
+}
+
+// proxyListeners wraps the listeners which have ProxyProtocol set in opts.
+func (s *Server) proxyListeners(opts map[string]ListenerOptions) {
+	for label, l := range s.Listeners {
+		if p := opts[label].Proxy; p != nil {
+			s.Listeners[label] = newProxyListener(l, p)
+		}
+	}
+}
+
+type proxyConn struct {
+	net.Conn
+	r        *bufio.Reader
+	src, dst net.Addr
+	err      error
+}
+
+// newProxyConn reads conn's PROXY header, taking no longer than timeout.
+func newProxyConn(conn net.Conn, timeout time.Duration) *proxyConn {
+	c := &proxyConn{Conn: conn, r: bufio.NewReader(conn)}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	c.src, c.dst, c.err = readProxyHeader(c.r)
+	conn.SetReadDeadline(time.Time{})
+	if c.err != nil {
+		vlog.VLogf("Bad PROXY header from %s: %s", conn.RemoteAddr(), c.err)
+	}
+	return c
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if c.src != nil {
+		return c.src
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	if c.dst != nil {
+		return c.dst
+	}
+	return c.Conn.LocalAddr()
+}
+
+var (
+	proxyV1Prefix = []byte("PROXY ")
+	proxyV2Sig    = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+	errNoProxyHeader = errors.New("no PROXY protocol header")
+)
+
+// maximum length of a v1 header, including the CRLF
+const proxyV1MaxLen = 107
+
+// readProxyHeader reads a PROXY protocol header from r, returning the
+// source and destination addresses it gives, if any.
+func readProxyHeader(r *bufio.Reader) (src, dst net.Addr, err error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch b[0] {
+	case proxyV1Prefix[0]:
+		return readProxyV1(r)
+	case proxyV2Sig[0]:
+		return readProxyV2(r)
+	}
+	return nil, nil, errNoProxyHeader
+}
+
+func readProxyV1(r *bufio.Reader) (src, dst net.Addr, err error) {
+	var line []byte
+	for len(line) < proxyV1MaxLen {
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, c)
+		if c == '\n' {
+			break
+		}
+	}
+	if !bytes.HasPrefix(line, proxyV1Prefix) {
+		return nil, nil, errNoProxyHeader
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, errors.New("PROXY v1 header too long or not terminated by CRLF")
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 {
+		return nil, nil, fmt.Errorf("malformed PROXY v1 header %q", line)
+	}
+	var ipLen int
+	switch fields[1] {
+	case "TCP4":
+		ipLen = net.IPv4len
+	case "TCP6":
+		ipLen = net.IPv6len
+	default:
+		return nil, nil, fmt.Errorf("unknown PROXY v1 protocol %q", fields[1])
+	}
+	srcAddr, err := parseV1Addr(fields[2], fields[4], ipLen)
+	if err != nil {
+		return nil, nil, err
+	}
+	dstAddr, err := parseV1Addr(fields[3], fields[5], ipLen)
+	if err != nil {
+		return nil, nil, err
+	}
+	return srcAddr, dstAddr, nil
+}
+
+func parseV1Addr(ip, port string, ipLen int) (*net.TCPAddr, error) {
+	addr := &net.TCPAddr{IP: net.ParseIP(ip)}
+	if addr.IP == nil || strings.Contains(ip, ":") != (ipLen == net.IPv6len) {
+		return nil, fmt.Errorf("bad address %q in PROXY v1 header", ip)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("bad port %q in PROXY v1 header", port)
+	}
+	addr.Port = int(p)
+	return addr, nil
+}
+
+// PROXY v2 address families and transport protocols
+const (
+	proxyAFUnspec = 0x0
+	proxyAFInet   = 0x1
+	proxyAFInet6  = 0x2
+	proxyAFUnix   = 0x3
+
+	proxyStream = 0x1
+	proxyDgram  = 0x2
+)
+
+func readProxyV2(r *bufio.Reader) (src, dst net.Addr, err error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, nil, err
+	}
+	if !bytes.Equal(hdr[:12], proxyV2Sig) {
+		return nil, nil, errNoProxyHeader
+	}
+	if version := hdr[12] >> 4; version != 2 {
+		return nil, nil, fmt.Errorf("unsupported PROXY protocol version %d", version)
+	}
+	command := hdr[12] & 0xf
+	family, transport := hdr[13]>>4, hdr[13]&0xf
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, nil, err
+	}
+
+	switch command {
+	case 0x0: // LOCAL
+		return nil, nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, nil, fmt.Errorf("unknown PROXY v2 command %#x", command)
+	}
+
+	var ipLen int
+	switch family {
+	case proxyAFUnspec:
+		return nil, nil, nil
+	case proxyAFInet:
+		ipLen = net.IPv4len
+	case proxyAFInet6:
+		ipLen = net.IPv6len
+	case proxyAFUnix:
+		const pathLen = 108
+		if len(body) < 2*pathLen {
+			return nil, nil, errors.New("short PROXY v2 unix address block")
+		}
+		network := "unix"
+		if transport == proxyDgram {
+			network = "unixgram"
+		}
+		return &net.UnixAddr{Name: cString(body[:pathLen]), Net: network},
+			&net.UnixAddr{Name: cString(body[pathLen : 2*pathLen]), Net: network}, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown PROXY v2 address family %#x", family)
+	}
+
+	if len(body) < 2*ipLen+4 {
+		return nil, nil, errors.New("short PROXY v2 address block")
+	}
+	srcIP := net.IP(append([]byte(nil), body[:ipLen]...))
+	dstIP := net.IP(append([]byte(nil), body[ipLen:2*ipLen]...))
+	srcPort := int(binary.BigEndian.Uint16(body[2*ipLen:]))
+	dstPort := int(binary.BigEndian.Uint16(body[2*ipLen+2:]))
+	switch transport {
+	case proxyStream:
+		return &net.TCPAddr{IP: srcIP, Port: srcPort}, &net.TCPAddr{IP: dstIP, Port: dstPort}, nil
+	case proxyDgram:
+		return &net.UDPAddr{IP: srcIP, Port: srcPort}, &net.UDPAddr{IP: dstIP, Port: dstPort}, nil
+	}
+	return nil, nil, fmt.Errorf("unknown PROXY v2 transport protocol %#x", transport)
+}
+
+// cString returns b up to its first NUL byte.
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
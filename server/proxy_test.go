@@ -0,0 +1,223 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func proxyV2Header(command, family byte, body []byte) []byte {
+	b := append([]byte(nil), proxyV2Sig...)
+	b = append(b, 0x20|command, family, 0, 0)
+	binary.BigEndian.PutUint16(b[14:], uint16(len(body)))
+	return append(b, body...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	unixBody := make([]byte, 216)
+	copy(unixBody, "/run/client.sock")
+	copy(unixBody[108:], "/run/server.sock")
+
+	for _, test := range []struct {
+		name     string
+		header   []byte
+		src, dst string
+		err      bool
+	}{
+		{name: "v1 tcp4", header: []byte("PROXY TCP4 192.0.2.1 198.51.100.2 56324 443\r\n"),
+			src: "192.0.2.1:56324", dst: "198.51.100.2:443"},
+		{name: "v1 tcp6", header: []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n"),
+			src: "[2001:db8::1]:56324", dst: "[2001:db8::2]:443"},
+		{name: "v1 unknown", header: []byte("PROXY UNKNOWN\r\n")},
+		{name: "v1 family mismatch", header: []byte("PROXY TCP4 2001:db8::1 2001:db8::2 1 2\r\n"), err: true},
+		{name: "v1 bad port", header: []byte("PROXY TCP4 192.0.2.1 198.51.100.2 70000 443\r\n"), err: true},
+		{name: "v1 missing CRLF", header: []byte("PROXY TCP4 192.0.2.1 198.51.100.2 1 2\n"), err: true},
+		{name: "v1 too long", header: []byte("PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n"), err: true},
+		{name: "v2 tcp4", header: proxyV2Header(1, 0x11, []byte{192, 0, 2, 1, 198, 51, 100, 2, 0xdc, 0x04, 0x01, 0xbb}),
+			src: "192.0.2.1:56324", dst: "198.51.100.2:443"},
+		{name: "v2 tcp6 with TLVs", header: proxyV2Header(1, 0x21, append(append(append(
+			net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::2").To16()...),
+			0xdc, 0x04, 0x01, 0xbb), 0x04, 0x00, 0x01, 0x00)),
+			src: "[2001:db8::1]:56324", dst: "[2001:db8::2]:443"},
+		{name: "v2 unix", header: proxyV2Header(1, 0x31, unixBody),
+			src: "/run/client.sock", dst: "/run/server.sock"},
+		{name: "v2 local", header: proxyV2Header(0, 0x00, nil)},
+		{name: "v2 short", header: proxyV2Header(1, 0x11, []byte{192, 0, 2, 1}), err: true},
+		{name: "not proxy", header: []byte("GET / HTTP/1.1\r\n"), err: true},
+	} {
+		r := bufio.NewReader(bytes.NewReader(append(test.header, "data"...)))
+		src, dst, err := readProxyHeader(r)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: no error reading header", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if got := addrString(src); got != test.src {
+			t.Errorf("%s: got source %q, expected %q", test.name, got, test.src)
+		}
+		if got := addrString(dst); got != test.dst {
+			t.Errorf("%s: got destination %q, expected %q", test.name, got, test.dst)
+		}
+		if rest, _ := ioutil.ReadAll(r); string(rest) != "data" {
+			t.Errorf("%s: got %q after header, expected data", test.name, rest)
+		}
+	}
+}
+
+func addrString(a net.Addr) string {
+	if a == nil {
+		return ""
+	}
+	return a.String()
+}
+
+func proxyServer(t *testing.T, proxy *ProxyProtocol) (*Server, string, chan net.Conn) {
+	addrs := map[string]string{"a": "127.0.0.1:0"}
+	s, err := NewServerWithOptions(addrs, map[string]ListenerOptions{"a": {Proxy: proxy}})
+	if err != nil {
+		t.Fatalf("NewServerWithOptions: %s", err)
+	}
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		for {
+			conn, err := s.Listeners["a"].Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+	return s, addrs["a"], accepted
+}
+
+func trustLoopback(t *testing.T) []*net.IPNet {
+	trusted, err := ParseCIDRs("127.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return trusted
+}
+
+func TestProxyListener(t *testing.T) {
+	s, addr, accepted := proxyServer(t, &ProxyProtocol{Trusted: trustLoopback(t)})
+	defer s.closeListeners()
+
+	c := dial(t, addr)
+	defer c.Close()
+	c.Write([]byte("PROXY TCP4 192.0.2.1 198.51.100.2 56324 443\r\nhello"))
+	conn := <-accepted
+	defer conn.Close()
+	if got := conn.RemoteAddr().String(); got != "192.0.2.1:56324" {
+		t.Errorf("got RemoteAddr %s, expected the client in the header", got)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	b := make([]byte, 5)
+	if _, err := conn.Read(b); err != nil || string(b) != "hello" {
+		t.Errorf("got %q, %v after header, expected hello", b, err)
+	}
+}
+
+func TestProxyListenerUntrusted(t *testing.T) {
+	trusted, err := ParseCIDRs("192.0.2.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, addr, accepted := proxyServer(t, &ProxyProtocol{Trusted: trusted})
+	defer s.closeListeners()
+
+	// a header from an untrusted source is just data
+	c := dial(t, addr)
+	defer c.Close()
+	header := "PROXY TCP4 192.0.2.1 198.51.100.2 56324 443\r\n"
+	c.Write([]byte(header))
+	conn := <-accepted
+	defer conn.Close()
+	if got := conn.RemoteAddr().String(); got != c.LocalAddr().String() {
+		t.Errorf("got RemoteAddr %s for untrusted source, expected %s", got, c.LocalAddr())
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	b := make([]byte, len(header))
+	if _, err := conn.Read(b); err != nil || string(b) != header {
+		t.Errorf("got %q, %v from untrusted source, expected the header as data", b, err)
+	}
+}
+
+func TestProxyListenerTimeout(t *testing.T) {
+	s, addr, accepted := proxyServer(t, &ProxyProtocol{Trusted: trustLoopback(t), Timeout: 50 * time.Millisecond})
+	defer s.closeListeners()
+
+	c := dial(t, addr)
+	defer c.Close()
+	c.Write([]byte("PROXY TCP4"))
+	conn := <-accepted
+	defer conn.Close()
+	start := time.Now()
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Errorf("Read succeeded with an incomplete header")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("reading incomplete header took %v", elapsed)
+	}
+	if got := conn.RemoteAddr().String(); got != c.LocalAddr().String() {
+		t.Errorf("got RemoteAddr %s after bad header, expected %s", got, c.LocalAddr())
+	}
+}
+
+func TestProxyListenerTrustsNoneByDefault(t *testing.T) {
+	s, addr, accepted := proxyServer(t, &ProxyProtocol{})
+	defer s.closeListeners()
+
+	c := dial(t, addr)
+	defer c.Close()
+	header := "PROXY TCP4 192.0.2.1 198.51.100.2 56324 443\r\n"
+	c.Write([]byte(header))
+	conn := <-accepted
+	defer conn.Close()
+	if got := conn.RemoteAddr().String(); got != c.LocalAddr().String() {
+		t.Errorf("got RemoteAddr %s with no trusted networks, expected %s", got, c.LocalAddr())
+	}
+}
+
+func TestProxyListenerSlowHeader(t *testing.T) {
+	s, addr, accepted := proxyServer(t, &ProxyProtocol{Trusted: trustLoopback(t)})
+	defer s.closeListeners()
+
+	// a client which hasn't sent its header yet doesn't hold up the others
+	slow := dial(t, addr)
+	defer slow.Close()
+	slow.Write([]byte("PROXY TCP4 192.0.2.9"))
+	c := dial(t, addr)
+	defer c.Close()
+	c.Write([]byte("PROXY TCP4 192.0.2.1 198.51.100.2 56324 443\r\n"))
+	var conn net.Conn
+	select {
+	case conn = <-accepted:
+	case <-time.After(time.Second):
+		t.Fatalf("connection held up by a slow header")
+	}
+	defer conn.Close()
+	if got := conn.RemoteAddr().String(); got != "192.0.2.1:56324" {
+		t.Errorf("got RemoteAddr %s, expected the client in the header", got)
+	}
+
+	slow.Write([]byte(" 198.51.100.2 56325 443\r\n"))
+	select {
+	case conn = <-accepted:
+		defer conn.Close()
+		if got := conn.RemoteAddr().String(); got != "192.0.2.9:56325" {
+			t.Errorf("got RemoteAddr %s, expected the slow client in the header", got)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("slow client not accepted after finishing its header")
+	}
+}
@@ -1,12 +1,18 @@
 package server
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net"
+	"os"
+	"sync"
+	"time"
 )
 
 /*
-   Server is a abstraction that uses a channel to implement synchronization
-   points between the server and its creator.
+   Server is a abstraction that implements synchronization points between the
+   server and its creator.
 
    Sync point                                   Caller method         Server method
    ----------------------------------------------------------------------------
@@ -16,8 +22,46 @@ import (
 
    Additionally, the Shutdown() client method is defer-friendly shorthand for
    calling RequestShutdown then WaitForFinish.
+
+   Each sync point is passed at most once. Signalling methods never block and
+   may be called more than once or out of order: a shutdown requested before
+   the server is ready is seen by WaitForShutdown as soon as it is called, and
+   waiting for readiness ends if the server finishes without becoming ready.
 */
 
+// State is the last sync point a Server has passed.
+type State int
+
+const (
+	// StateStarting is the state of a new Server, until SignalReady.
+	StateStarting State = iota
+	// StateReady means SignalReady has been called.
+	StateReady
+	// StateStopping means RequestShutdown has been called.
+	StateStopping
+	// StateFinished means SignalFinish has been called.
+	StateFinished
+)
+
+func (st State) String() string {
+	switch st {
+	case StateStarting:
+		return "starting"
+	case StateReady:
+		return "ready"
+	case StateStopping:
+		return "stopping"
+	case StateFinished:
+		return "finished"
+	}
+	return fmt.Sprintf("State(%d)", int(st))
+}
+
+// ErrFinished is returned by WaitForReadyContext if the server finished
+// without ever becoming ready.
+var ErrFinished = errors.New("server finished without becoming ready")
+
+// Ping, Signal and SignalChan are unused, and remain only for compatibility.
 var Ping Signal
 
 type (
@@ -27,29 +71,82 @@ type (
 
 type Server struct {
 	Listeners map[string]net.Listener
-	control   SignalChan
-	stopping  bool
+	// PacketConns holds the sockets for labels with packet-oriented
+	// addresses (udp, udp4, udp6 and unixgram).
+	PacketConns map[string]net.PacketConn
+	// DrainTimeout, if non-zero, makes WaitForShutdown wait up to this long
+	// for connections accepted by Listeners with TrackConns set to be closed
+	// after it closes the listeners, and then close those which remain. See
+	// Drain.
+	DrainTimeout time.Duration
+	conns        *connTracker
+	limiters     map[string]*limitedListener
+
+	syncOnce sync.Once
+	mu       sync.Mutex
+	ready    chan struct{}
+	stopping chan struct{}
+	finished chan struct{}
+
+	upgradeReady *os.File
+	servingHTTP  bool // ServeHTTPServer has been called
 }
 
 // addrs is updated with the actual listener address after binding. This allows
 // requesting a random unused port by omitting the port part of an Addr.
+//
+// An address may be prefixed with a network as understood by net.Listen,
+// e.g. "unix:/run/foo.sock", "tcp6:[::1]:0" or "udp::514". Addresses without
+// a prefix are tcp. Labels with udp or unixgram addresses get a PacketConn
+// rather than a Listener. The address written back to addrs keeps its prefix.
+//
+// The Listeners are those returned by net.Listen. To count connections and
+// drain them during shutdown, see ListenerOptions.TrackConns.
 func NewServer(addrs map[string]string) (s *Server, err error) {
+	return newServer(addrs, nil, nil)
+}
+
+// NewServerWithOptions is NewServer, with per-label options for creating the
+// listeners. Labels missing from opts use the zero ListenerOptions.
+func NewServerWithOptions(addrs map[string]string, opts map[string]ListenerOptions) (s *Server, err error) {
+	return newServer(addrs, opts, nil)
+}
+
+// newServer binds listeners for addrs, except for labels found in inherited.
+// Bound and inherited listeners alike are wrapped according to opts.
+func newServer(addrs map[string]string, opts map[string]ListenerOptions, inherited map[string]socket) (s *Server, err error) {
 	s = &Server{
-		Listeners: make(map[string]net.Listener),
-		control:   make(SignalChan),
+		Listeners:   make(map[string]net.Listener),
+		PacketConns: make(map[string]net.PacketConn),
+		conns:       newConnTracker(),
 	}
 
 	for label, addr := range addrs {
-		var listener net.Listener
-		listener, err = net.Listen("tcp", addr)
-		if err != nil {
-			s.closeListeners()
-			s = nil
-			return
+		sock, ok := inherited[label]
+		bound := addr
+		if ok {
+			bound = sock.addr().String()
+			if network, _, prefixed := parseAddr(addr); prefixed {
+				bound = network + ":" + bound
+			}
+		} else {
+			sock, bound, err = listen(addr, opts[label])
+			if err != nil {
+				s.closeListeners()
+				s = nil
+				return
+			}
+		}
+		if sock.packet != nil {
+			s.PacketConns[label] = sock.packet
+		} else {
+			s.Listeners[label] = sock.listener
 		}
-		s.Listeners[label] = listener
-		addrs[label] = listener.Addr().String()
+		addrs[label] = bound
 	}
+	s.limitListeners(opts)
+	s.proxyListeners(opts)
+	s.trackListeners(opts)
 	return
 }
 
@@ -82,48 +179,107 @@ func (s *Server) SetListener(listener net.Listener) {
 	s.Listeners[SINGLE] = listener
 }
 
+// WaitForReady blocks until the server calls SignalReady or SignalFinish.
 func (s *Server) WaitForReady() {
+	s.WaitForReadyContext(context.Background())
+}
+
+// WaitForReadyContext is WaitForReady, but gives up and returns ctx.Err() if
+// ctx is done first. ErrFinished is returned if the server finished without
+// becoming ready.
+func (s *Server) WaitForReadyContext(ctx context.Context) error {
 	if s == nil {
-		return
+		return nil
+	}
+	s.initSync()
+	select {
+	case <-s.ready:
+		return nil
+	default:
+	}
+	select {
+	case <-s.ready:
+		return nil
+	case <-s.finished:
+		return ErrFinished
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-	<-s.control
 }
 
+// RequestShutdown asks the server to stop accepting connections. It doesn't
+// wait for the server to notice.
 func (s *Server) RequestShutdown() {
 	if s == nil {
 		return
 	}
-	s.stopping = true
-	s.control <- Ping
+	s.initSync()
+	s.closeOnce(s.stopping)
 }
 
+// WaitForFinish blocks until the server calls SignalFinish.
 func (s *Server) WaitForFinish() {
+	s.WaitForFinishContext(context.Background())
+}
+
+// WaitForFinishContext is WaitForFinish, but gives up and returns ctx.Err()
+// if ctx is done first.
+func (s *Server) WaitForFinishContext(ctx context.Context) error {
 	if s == nil {
-		return
+		return nil
 	}
-	<-s.control
+	s.initSync()
+	select {
+	case <-s.finished:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Done returns a channel which is closed when the server calls SignalFinish.
+func (s *Server) Done() <-chan struct{} {
+	if s == nil {
+		c := make(chan struct{})
+		close(c)
+		return c
+	}
+	s.initSync()
+	return s.finished
 }
 
 func (s *Server) SignalReady() {
 	if s == nil {
 		return
 	}
-	s.control <- Ping
+	s.initSync()
+	s.mu.Lock()
+	s.notifyUpgraded()
+	s.mu.Unlock()
+	s.closeOnce(s.ready)
 }
 
+// WaitForShutdown blocks until RequestShutdown is called, then closes the
+// listeners, draining their connections if DrainTimeout is set.
 func (s *Server) WaitForShutdown() {
 	if s == nil {
 		return
 	}
-	<-s.control
-	s.closeListeners()
+	s.initSync()
+	<-s.stopping
+	if s.DrainTimeout > 0 {
+		s.Drain(s.DrainTimeout)
+	} else {
+		s.closeListeners()
+	}
 }
 
 func (s *Server) SignalFinish() {
 	if s == nil {
 		return
 	}
-	s.control <- Ping
+	s.initSync()
+	s.closeOnce(s.finished)
 }
 
 func (s *Server) closeListeners() {
@@ -135,6 +291,11 @@ func (s *Server) closeListeners() {
 			listener.Close()
 		}
 	}
+	for _, conn := range s.PacketConns {
+		if conn != nil {
+			conn.Close()
+		}
+	}
 }
 
 func (s *Server) Shutdown() {
@@ -146,5 +307,54 @@ func (s *Server) Shutdown() {
 }
 
 func (s *Server) IsStopping() bool {
-	return s.stopping
+	if s == nil {
+		return false
+	}
+	s.initSync()
+	select {
+	case <-s.stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// State returns the latest sync point s has passed. Sync points may be passed
+// out of order, e.g. a shutdown requested before the server is ready leaves it
+// in StateStopping.
+func (s *Server) State() State {
+	if s == nil {
+		return StateFinished
+	}
+	s.initSync()
+	for _, st := range []struct {
+		c     chan struct{}
+		state State
+	}{{s.finished, StateFinished}, {s.stopping, StateStopping}, {s.ready, StateReady}} {
+		select {
+		case <-st.c:
+			return st.state
+		default:
+		}
+	}
+	return StateStarting
+}
+
+func (s *Server) initSync() {
+	s.syncOnce.Do(func() {
+		s.ready = make(chan struct{})
+		s.stopping = make(chan struct{})
+		s.finished = make(chan struct{})
+	})
+}
+
+// closeOnce closes c unless it has been closed already.
+func (s *Server) closeOnce(c chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-c:
+	default:
+		close(c)
+	}
 }
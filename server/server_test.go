@@ -0,0 +1,98 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSyncPoints(t *testing.T) {
+	addr := "127.0.0.1:0"
+	s, err := NewSingleServer(&addr)
+	if err != nil {
+		t.Fatalf("NewSingleServer: %s", err)
+	}
+	go func() {
+		s.SignalReady()
+		s.WaitForShutdown()
+		s.SignalFinish()
+	}()
+	s.WaitForReady()
+	if st := s.State(); st != StateReady {
+		t.Errorf("got state %v after WaitForReady, expected %v", st, StateReady)
+	}
+	if s.IsStopping() {
+		t.Errorf("server stopping before shutdown was requested")
+	}
+	s.Shutdown()
+	if !s.IsStopping() {
+		t.Errorf("server not stopping after Shutdown")
+	}
+	select {
+	case <-s.Done():
+	default:
+		t.Errorf("Done not closed after Shutdown")
+	}
+	if st := s.State(); st != StateFinished {
+		t.Errorf("got state %v after Shutdown, expected %v", st, StateFinished)
+	}
+}
+
+func TestSyncPointsOutOfOrder(t *testing.T) {
+	var s Server
+
+	// none of the signalling methods should block, however often they're
+	// called, even with nobody waiting
+	s.RequestShutdown()
+	s.RequestShutdown()
+	if st := s.State(); st != StateStopping {
+		t.Errorf("got state %v after RequestShutdown, expected %v", st, StateStopping)
+	}
+	s.WaitForShutdown()
+	s.SignalReady()
+	s.SignalReady()
+	s.SignalFinish()
+	s.SignalFinish()
+
+	s.WaitForReady()
+	s.WaitForFinish()
+	s.Shutdown()
+}
+
+func TestWaitForReadyAfterFinish(t *testing.T) {
+	var s Server
+	s.SignalFinish()
+	if err := s.WaitForReadyContext(context.Background()); err != ErrFinished {
+		t.Errorf("WaitForReadyContext returned %v, expected ErrFinished", err)
+	}
+	s.SignalReady()
+	if err := s.WaitForReadyContext(context.Background()); err != nil {
+		t.Errorf("WaitForReadyContext returned %v once ready", err)
+	}
+}
+
+func TestWaitContextTimeout(t *testing.T) {
+	var s Server
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := s.WaitForReadyContext(ctx); err != context.DeadlineExceeded {
+		t.Errorf("WaitForReadyContext returned %v, expected a timeout", err)
+	}
+	if err := s.WaitForFinishContext(ctx); err != context.DeadlineExceeded {
+		t.Errorf("WaitForFinishContext returned %v, expected a timeout", err)
+	}
+}
+
+func TestSyncPointsConcurrent(t *testing.T) {
+	var s Server
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(4)
+		go func() { defer wg.Done(); s.WaitForReady() }()
+		go func() { defer wg.Done(); s.WaitForFinish() }()
+		go func() { defer wg.Done(); s.SignalReady(); s.RequestShutdown() }()
+		go func() { defer wg.Done(); s.WaitForShutdown(); s.SignalFinish() }()
+	}
+	wg.Wait()
+}
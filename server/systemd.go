@@ -0,0 +1,51 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/fastly/go-utils/systemd"
+	"github.com/fastly/go-utils/vlog"
+)
+
+// NewActivatedServer is NewServer for a daemon which may be socket activated
+// by systemd. Sockets passed in by systemd are adopted for the labels in addrs
+// matching their FileDescriptorName=; other labels are bound as usual, and
+// passed sockets which match no label are closed.
+func NewActivatedServer(addrs map[string]string) (s *Server, err error) {
+	return NewActivatedServerWithOptions(addrs, nil)
+}
+
+// NewActivatedServerWithOptions is NewActivatedServer, with per-label options
+// as for NewServerWithOptions. Activated sockets are wrapped according to
+// their options just as new ones are; Mode, Owner and Group only apply to
+// unix sockets which are bound rather than activated.
+func NewActivatedServerWithOptions(addrs map[string]string, opts map[string]ListenerOptions) (s *Server, err error) {
+	files, err := systemd.ListenFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	inherited := make(map[string]socket, len(files))
+	for i, f := range files {
+		label := f.Name()
+		var sock socket
+		if _, dup := inherited[label]; dup {
+			err = fmt.Errorf("more than one activated socket is named %q", label)
+		} else if sock, err = fileSocket(f); err != nil {
+			err = fmt.Errorf("couldn't adopt activated socket %q: %s", label, err)
+		}
+		f.Close()
+		if err != nil {
+			for _, f := range files[i+1:] {
+				f.Close()
+			}
+			for _, sock := range inherited {
+				sock.close()
+			}
+			return nil, err
+		}
+		vlog.VLogf("Adopted activated socket %q on %s", label, sock.addr())
+		inherited[label] = sock
+	}
+	return adoptListeners(addrs, opts, inherited)
+}
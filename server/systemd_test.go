@@ -0,0 +1,77 @@
+package server
+
+import (
+	"bufio"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"testing"
+	"time"
+)
+
+const activatedTestEnv = "__server_test_activated"
+
+func init() {
+	if os.Getenv(activatedTestEnv) != "" {
+		activatedChild()
+	}
+}
+
+// activatedChild is run by TestNewActivatedServer in place of systemd's
+// socket-activated service.
+func activatedChild() {
+	defer os.Exit(0)
+	// systemd sets LISTEN_PID after forking, which we can't do from the test
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	addrs := map[string]string{"web": "127.0.0.1:0", "admin": "127.0.0.1:0"}
+	s, err := NewActivatedServer(addrs)
+	if err != nil {
+		log.Fatalf("NewActivatedServer: %s", err)
+	}
+	l := s.Listeners["web"]
+	l.(*net.TCPListener).SetDeadline(time.Now().Add(5 * time.Second))
+	conn, err := l.Accept()
+	if err != nil {
+		log.Fatalf("Accept: %s", err)
+	}
+	conn.Write([]byte(addrs["web"] + "\n"))
+	conn.Close()
+}
+
+func TestNewActivatedServer(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	f, err := l.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(os.Args[0])
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{f}
+	cmd.Env = append(os.Environ(), activatedTestEnv+"=1", "LISTEN_FDS=1", "LISTEN_FDNAMES=web")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer cmd.Wait()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatalf("ReadString: %s", err)
+	}
+	if expected := l.Addr().String() + "\n"; line != expected {
+		t.Errorf("child reported %q for its activated socket, expected %q", line, expected)
+	}
+}
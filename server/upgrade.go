@@ -0,0 +1,270 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fastly/go-utils/executable"
+	"github.com/fastly/go-utils/vlog"
+)
+
+const (
+	// upgradeEnv names the labels of the listeners handed to a new process by
+	// Upgrade, query-escaped and comma-separated in fd order.
+	upgradeEnv = "__server_upgrade"
+
+	// os/exec on Cmd.ExtraFiles: "If non-nil, entry i becomes file descriptor 3+i."
+	// so the readiness pipe is fd 3 in the new process, and the listeners
+	// follow it
+	upgradeReadyFd          = 3
+	upgradeListenerFdOffset = upgradeReadyFd + 1
+
+	upgradeReady = "ready"
+)
+
+type filer interface {
+	File() (*os.File, error)
+}
+
+// NewInheritedServer is NewServer, except that if this process was started by
+// Upgrade, listeners handed over by the old process are adopted for the
+// matching labels in addrs rather than binding new sockets. Inherited
+// listeners whose labels aren't in addrs are closed. When the new Server calls
+// SignalReady, the old process is told that it can begin shutting down.
+func NewInheritedServer(addrs map[string]string) (s *Server, err error) {
+	return NewInheritedServerWithOptions(addrs, nil)
+}
+
+// NewInheritedServerWithOptions is NewInheritedServer, with per-label options
+// as for NewServerWithOptions. Inherited listeners are wrapped according to
+// their options just as new ones are; Mode, Owner and Group only apply to
+// unix sockets which are bound rather than inherited.
+func NewInheritedServerWithOptions(addrs map[string]string, opts map[string]ListenerOptions) (s *Server, err error) {
+	inherited, ready, err := inheritedListeners()
+	if err != nil {
+		return nil, err
+	}
+	if s, err = adoptListeners(addrs, opts, inherited); err != nil {
+		if ready != nil {
+			ready.Close()
+		}
+		return nil, err
+	}
+	s.upgradeReady = ready
+	return s, nil
+}
+
+// adoptListeners is newServer, except that sockets in inherited whose labels
+// aren't in addrs are closed, as are all of them if there's an error.
+func adoptListeners(addrs map[string]string, opts map[string]ListenerOptions, inherited map[string]socket) (s *Server, err error) {
+	if s, err = newServer(addrs, opts, inherited); err != nil {
+		for _, sock := range inherited {
+			sock.close()
+		}
+		return nil, err
+	}
+	for label, sock := range inherited {
+		if _, ok := addrs[label]; !ok {
+			vlog.VLogf("Closing inherited socket %q on %s: no such label", label, sock.addr())
+			sock.close()
+		}
+	}
+	return s, nil
+}
+
+// NewInheritedSingleServer is NewSingleServer for a process which may have been
+// started by Upgrade. See NewInheritedServer.
+func NewInheritedSingleServer(addr *string) (s *Server, err error) {
+	a := map[string]string{SINGLE: *addr}
+	if s, err = NewInheritedServer(a); err != nil {
+		return nil, err
+	}
+	*addr = a[SINGLE]
+	return
+}
+
+// Upgrade starts a new copy of the running executable with the same arguments
+// and hands it duplicates of s's listeners and packet connections, which it
+// can adopt with
+// NewInheritedServer. Upgrade returns the new process once that process's
+// Server calls SignalReady. If the new process exits first or isn't ready
+// within timeout (when non-zero), it is killed and an error is returned.
+//
+// s keeps accepting connections throughout; once Upgrade succeeds the caller
+// should shut s down, after which the new process serves every connection.
+// Closing s's unix socket listeners then leaves their paths in place for the
+// new process.
+func (s *Server) Upgrade(timeout time.Duration) (*os.Process, error) {
+	if s == nil {
+		return nil, errors.New("can't upgrade a nil Server")
+	}
+	bin, err := executable.Path()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't find own executable: %s", err)
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	files := []*os.File{w}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	sockets := make(map[string]interface{}, len(s.Listeners)+len(s.PacketConns))
+	for label, l := range s.Listeners {
+		sockets[label] = l
+	}
+	for label, c := range s.PacketConns {
+		sockets[label] = c
+	}
+	labels := make([]string, 0, len(sockets))
+	for label := range sockets {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+
+	// the new process serves our unix sockets from now on, so closing our
+	// listeners mustn't remove their paths, unless the upgrade fails
+	var unlinked []*net.UnixListener
+	for _, l := range s.Listeners {
+		if ul, ok := UnwrapListener(l).(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+			unlinked = append(unlinked, ul)
+		}
+	}
+	succeeded := false
+	defer func() {
+		if !succeeded {
+			for _, ul := range unlinked {
+				ul.SetUnlinkOnClose(true)
+			}
+		}
+	}()
+
+	names := make([]string, len(labels))
+	for i, label := range labels {
+		l, ok := sockets[label].(filer)
+		if !ok {
+			return nil, fmt.Errorf("socket %q (%T) can't be passed to another process", label, sockets[label])
+		}
+		f, err := l.File()
+		if err != nil {
+			return nil, fmt.Errorf("couldn't get file for listener %q: %s", label, err)
+		}
+		files = append(files, f)
+		names[i] = url.QueryEscape(label)
+	}
+
+	cmd := exec.Command(bin, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	for _, v := range os.Environ() {
+		if !strings.HasPrefix(v, upgradeEnv+"=") {
+			cmd.Env = append(cmd.Env, v)
+		}
+	}
+	cmd.Env = append(cmd.Env, upgradeEnv+"="+strings.Join(names, ","))
+
+	if err = cmd.Start(); err != nil {
+		return nil, fmt.Errorf("couldn't start new process: %s", err)
+	}
+	vlog.VLogf("Started new process %d with %d listeners, waiting for it to become ready", cmd.Process.Pid, len(labels))
+
+	// the new process has its own copies now. closing ours means the read
+	// below sees EOF if the new process exits.
+	for _, f := range files {
+		f.Close()
+	}
+	files = nil
+
+	ready := make(chan bool, 1)
+	go func() {
+		line, _ := bufio.NewReader(r).ReadString('\n')
+		ready <- line == upgradeReady+"\n"
+	}()
+	var t <-chan time.Time
+	if timeout > 0 {
+		t = time.After(timeout)
+	}
+	select {
+	case ok := <-ready:
+		if ok {
+			succeeded = true
+			return cmd.Process, nil
+		}
+		err = fmt.Errorf("new process %d exited before becoming ready", cmd.Process.Pid)
+	case <-t:
+		err = fmt.Errorf("new process %d wasn't ready within %v", cmd.Process.Pid, timeout)
+	}
+	cmd.Process.Kill()
+	cmd.Wait()
+	return nil, err
+}
+
+// inheritedListeners returns the sockets and readiness pipe passed to this
+// process by Upgrade, if any.
+func inheritedListeners() (sockets map[string]socket, ready *os.File, err error) {
+	v, ok := os.LookupEnv(upgradeEnv)
+	if !ok {
+		return
+	}
+	// don't let any of our own children think they're being upgraded
+	os.Unsetenv(upgradeEnv)
+
+	ready = os.NewFile(upgradeReadyFd, "upgrade-ready")
+	sockets = make(map[string]socket)
+	if v == "" {
+		return
+	}
+	for i, name := range strings.Split(v, ",") {
+		var label string
+		if label, err = url.QueryUnescape(name); err != nil {
+			break
+		}
+		f := os.NewFile(upgradeListenerFdOffset+uintptr(i), "listener-"+label)
+		var sock socket
+		sock, err = fileSocket(f)
+		f.Close()
+		if err != nil {
+			err = fmt.Errorf("couldn't adopt inherited socket %q: %s", label, err)
+			break
+		}
+		vlog.VLogf("Inherited socket %q on %s", label, sock.addr())
+		sockets[label] = sock
+	}
+	if err != nil {
+		for _, sock := range sockets {
+			sock.close()
+		}
+		ready.Close()
+		return nil, nil, err
+	}
+	return
+}
+
+// notifyUpgraded tells the process which started this one with Upgrade that
+// s is ready.
+func (s *Server) notifyUpgraded() {
+	if s.upgradeReady == nil {
+		return
+	}
+	fmt.Fprintln(s.upgradeReady, upgradeReady)
+	s.upgradeReady.Close()
+	s.upgradeReady = nil
+}
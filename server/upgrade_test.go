@@ -0,0 +1,191 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const (
+	upgradeTestLabel = "test,label"
+	// the path of the unix socket the child of TestUpgradeUnix serves
+	upgradeUnixTestEnv = "__server_test_upgrade_unix"
+	// set for the child of TestUpgradeProxy, which expects PROXY headers
+	upgradeProxyTestEnv = "__server_test_upgrade_proxy"
+)
+
+func init() {
+	if _, ok := os.LookupEnv(upgradeEnv); ok {
+		upgradeChild()
+	}
+}
+
+// upgradeChild is run by the new process started in TestUpgrade. It serves
+// a single connection on the inherited listener and exits.
+func upgradeChild() {
+	defer os.Exit(0)
+	addrs := map[string]string{upgradeTestLabel: "127.0.0.1:0"}
+	unixPath := os.Getenv(upgradeUnixTestEnv)
+	if unixPath != "" {
+		addrs[upgradeTestLabel] = "unix:" + unixPath
+	}
+	var opts map[string]ListenerOptions
+	_, proxy := os.LookupEnv(upgradeProxyTestEnv)
+	if proxy {
+		trusted, _ := ParseCIDRs("127.0.0.0/8")
+		opts = map[string]ListenerOptions{upgradeTestLabel: {Proxy: &ProxyProtocol{Trusted: trusted}}}
+	}
+	s, err := NewInheritedServerWithOptions(addrs, opts)
+	if err != nil {
+		log.Fatalf("NewInheritedServerWithOptions: %s", err)
+	}
+	go s.WaitForReady()
+	s.SignalReady()
+
+	l := s.Listeners[upgradeTestLabel]
+	l.(interface {
+		SetDeadline(time.Time) error
+	}).SetDeadline(time.Now().Add(5 * time.Second))
+	conn, err := l.Accept()
+	if err != nil {
+		log.Fatalf("Accept: %s", err)
+	}
+	fmt.Fprintf(conn, "%d\n", os.Getpid())
+	if proxy {
+		fmt.Fprintf(conn, "%s\n", conn.RemoteAddr())
+	}
+	conn.Close()
+}
+
+func TestUpgrade(t *testing.T) {
+	addrs := map[string]string{upgradeTestLabel: "127.0.0.1:0"}
+	s, err := NewServer(addrs)
+	if err != nil {
+		t.Fatalf("NewServer: %s", err)
+	}
+	proc, err := s.Upgrade(5 * time.Second)
+	if err != nil {
+		s.closeListeners()
+		t.Fatalf("Upgrade: %s", err)
+	}
+	defer proc.Wait()
+
+	// once the old process stops listening, the new one must take over
+	s.closeListeners()
+	conn, err := net.Dial("tcp", addrs[upgradeTestLabel])
+	if err != nil {
+		t.Fatalf("Dial: %s", err)
+	}
+	defer conn.Close()
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatalf("ReadString: %s", err)
+	}
+	if expected := fmt.Sprintf("%d\n", proc.Pid); line != expected {
+		t.Errorf("got %q from new process, expected %q", line, expected)
+	}
+}
+
+func TestUpgradeUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upgrade")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.sock")
+	addrs := map[string]string{upgradeTestLabel: "unix:" + path}
+	s, err := NewServer(addrs)
+	if err != nil {
+		t.Fatalf("NewServer: %s", err)
+	}
+	os.Setenv(upgradeUnixTestEnv, path)
+	defer os.Unsetenv(upgradeUnixTestEnv)
+	proc, err := s.Upgrade(5 * time.Second)
+	if err != nil {
+		s.closeListeners()
+		t.Fatalf("Upgrade: %s", err)
+	}
+	defer proc.Wait()
+
+	// closing the old listener mustn't remove the socket the new process
+	// is serving
+	s.closeListeners()
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("socket gone after the old process closed its listener: %s", err)
+	}
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("Dial: %s", err)
+	}
+	defer conn.Close()
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatalf("ReadString: %s", err)
+	}
+	if expected := fmt.Sprintf("%d\n", proc.Pid); line != expected {
+		t.Errorf("got %q from new process, expected %q", line, expected)
+	}
+}
+
+func TestUpgradeProxy(t *testing.T) {
+	trusted, _ := ParseCIDRs("127.0.0.0/8")
+	addrs := map[string]string{upgradeTestLabel: "127.0.0.1:0"}
+	opts := map[string]ListenerOptions{upgradeTestLabel: {Proxy: &ProxyProtocol{Trusted: trusted}}}
+	s, err := NewServerWithOptions(addrs, opts)
+	if err != nil {
+		t.Fatalf("NewServerWithOptions: %s", err)
+	}
+	os.Setenv(upgradeProxyTestEnv, "1")
+	defer os.Unsetenv(upgradeProxyTestEnv)
+	proc, err := s.Upgrade(5 * time.Second)
+	if err != nil {
+		s.closeListeners()
+		t.Fatalf("Upgrade: %s", err)
+	}
+	defer proc.Wait()
+
+	// the inherited listener must still read PROXY headers
+	s.closeListeners()
+	conn, err := net.Dial("tcp", addrs[upgradeTestLabel])
+	if err != nil {
+		t.Fatalf("Dial: %s", err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "PROXY TCP4 192.0.2.1 198.51.100.2 56324 443\r\n")
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatalf("ReadString: %s", err)
+	}
+	if expected := fmt.Sprintf("%d\n", proc.Pid); line != expected {
+		t.Errorf("got %q from new process, expected %q", line, expected)
+	}
+	line, err = r.ReadString('\n')
+	if err != nil {
+		t.Fatalf("ReadString: %s", err)
+	}
+	if expected := "192.0.2.1:56324\n"; line != expected {
+		t.Errorf("new process saw the connection from %q, expected %q", line, expected)
+	}
+}
+
+func TestNewInheritedServerWithoutParent(t *testing.T) {
+	addr := "127.0.0.1:0"
+	s, err := NewInheritedSingleServer(&addr)
+	if err != nil {
+		t.Fatalf("NewInheritedSingleServer: %s", err)
+	}
+	defer s.closeListeners()
+	if addr == "127.0.0.1:0" {
+		t.Errorf("address wasn't updated after binding")
+	}
+	if s.upgradeReady != nil {
+		t.Errorf("server without a parent has an upgrade pipe")
+	}
+}
@@ -0,0 +1,115 @@
+// Package systemd implements the parts of the systemd service protocol that
+// daemons need without linking against libsystemd: readiness and status
+// notification (sd_notify(3)), watchdog keep-alives, and socket activation
+// (sd_listen_fds(3)).
+//
+// Every function is a harmless no-op when the process wasn't started by
+// systemd.
+package systemd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Well-known sd_notify states.
+const (
+	Ready     = "READY=1"
+	Stopping  = "STOPPING=1"
+	Reloading = "RELOADING=1"
+	Watchdog  = "WATCHDOG=1"
+)
+
+// Notify sends state to the service manager over the datagram socket named
+// by $NOTIFY_SOCKET. Multiple newline-separated assignments may be sent at
+// once. sent is false if there is no service manager to notify.
+func Notify(state string) (sent bool, err error) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return false, nil
+	}
+	// abstract socket names begin with @, which package net understands
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte(state)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Status sends a free-form description of the service's state, which
+// systemctl status displays.
+func Status(status string) (bool, error) {
+	return Notify("STATUS=" + status)
+}
+
+// WatchdogInterval returns the interval within which the service manager
+// expects a Watchdog notification, or 0 if the watchdog isn't enabled for
+// this process.
+func WatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// first file descriptor passed by socket activation
+const listenFdsStart = 3
+
+// ListenFiles returns the file descriptors passed to this process by socket
+// activation, in order. Each file's Name is its entry in $LISTEN_FDNAMES, or
+// "unknown" as systemd names them by default. The descriptors are marked
+// close-on-exec and the activation environment variables are unset so that
+// child processes don't try to claim them too.
+func ListenFiles() ([]*os.File, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	pid := os.Getenv("LISTEN_PID")
+	if pid == "" {
+		return nil, nil
+	}
+	if pid != strconv.Itoa(os.Getpid()) {
+		// meant for another process
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("bad LISTEN_FDS %q", os.Getenv("LISTEN_FDS"))
+	}
+	var names []string
+	if v := os.Getenv("LISTEN_FDNAMES"); v != "" {
+		names = strings.Split(v, ":")
+		if len(names) != n {
+			return nil, errors.New("LISTEN_FDNAMES doesn't match LISTEN_FDS")
+		}
+	}
+
+	files := make([]*os.File, n)
+	for i := range files {
+		fd := listenFdsStart + i
+		syscall.CloseOnExec(fd)
+		name := "unknown"
+		if names != nil {
+			name = names[i]
+		}
+		files[i] = os.NewFile(uintptr(fd), name)
+	}
+	return files, nil
+}
@@ -0,0 +1,93 @@
+package systemd
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// listenNotify stands in for systemd's notification socket.
+func listenNotify(t *testing.T) (*net.UnixConn, func()) {
+	dir, err := ioutil.TempDir("", "systemd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	os.Setenv("NOTIFY_SOCKET", path)
+	return conn, func() {
+		os.Unsetenv("NOTIFY_SOCKET")
+		conn.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestNotify(t *testing.T) {
+	os.Unsetenv("NOTIFY_SOCKET")
+	if sent, err := Notify(Ready); sent || err != nil {
+		t.Errorf("Notify without NOTIFY_SOCKET: got %v, %v", sent, err)
+	}
+
+	conn, cleanup := listenNotify(t)
+	defer cleanup()
+
+	for _, state := range []string{Ready, "STATUS=serving"} {
+		var sent bool
+		var err error
+		if state == Ready {
+			sent, err = Notify(state)
+		} else {
+			sent, err = Status("serving")
+		}
+		if !sent || err != nil {
+			t.Fatalf("Notify(%q): got %v, %v", state, sent, err)
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		b := make([]byte, 1024)
+		n, err := conn.Read(b)
+		if err != nil {
+			t.Fatalf("Read: %s", err)
+		}
+		if got := string(b[:n]); got != state {
+			t.Errorf("got %q, expected %q", got, state)
+		}
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	defer os.Unsetenv("WATCHDOG_USEC")
+	defer os.Unsetenv("WATCHDOG_PID")
+
+	os.Unsetenv("WATCHDOG_USEC")
+	if d := WatchdogInterval(); d != 0 {
+		t.Errorf("got %v with no WATCHDOG_USEC, expected 0", d)
+	}
+	os.Setenv("WATCHDOG_USEC", "1500000")
+	if d := WatchdogInterval(); d != 1500*time.Millisecond {
+		t.Errorf("got %v, expected 1.5s", d)
+	}
+	os.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()+1))
+	if d := WatchdogInterval(); d != 0 {
+		t.Errorf("got %v for another process's watchdog, expected 0", d)
+	}
+}
+
+func TestListenFilesForAnotherProcess(t *testing.T) {
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	os.Setenv("LISTEN_FDS", "1")
+	files, err := ListenFiles()
+	if files != nil || err != nil {
+		t.Errorf("got %v, %v, expected nothing", files, err)
+	}
+	if v := os.Getenv("LISTEN_FDS"); v != "" {
+		t.Errorf("LISTEN_FDS wasn't unset")
+	}
+}